@@ -0,0 +1,178 @@
+package tumble
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Archive bundles the logfile and all of its archives (decompressed) into
+// a single .tar.gz file at dst, from oldest to newest. Everything is
+// streamed, so memory usage doesn't depend on the size of the logs.
+// The mill is paused while the archives are read.
+func (me *Logger) Archive(dst string) (err error) {
+	// The logfile is opened and the archives are listed (with the mill
+	// paused) under the write lock, so a rotation can't move a segment out
+	// of the logfile in between. Writes (and rotations) may go on while we
+	// copy, as only what was listed is copied.
+	me.mu.Lock()
+	logf, size, err := me.openLogfileSnapshot()
+	if err != nil {
+		me.mu.Unlock()
+		return err
+	}
+	if logf != nil {
+		defer logf.Close()
+	}
+	me.millMu.Lock()
+	defer me.millMu.Unlock()
+	oldFiles, err := me.oldLogFiles()
+	me.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, me.fileMode())
+	if err != nil {
+		return fmt.Errorf("can't open archive: %s", err)
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	if err := me.archiveBackups(tw, oldFiles); err != nil {
+		return err
+	}
+	if logf != nil {
+		if err := me.archiveFile(tw, logf, filepath.Base(me.fpath()), size); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("can't write archive: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("can't write archive: %s", err)
+	}
+	return nil
+}
+
+// archiveBackups adds the given archives to tw. The caller holds millMu.
+func (me *Logger) archiveBackups(tw *tar.Writer, oldFiles []logInfo) error {
+	// An uncompressed archive takes precedence over a (partial) compressed one
+	uncompressed := make(map[string]bool)
+	for _, f := range oldFiles {
+		if !me.isCompressed(f.Name()) {
+			uncompressed[f.Name()] = true
+		}
+	}
+
+	// oldFiles is sorted from newest to oldest
+	for i := len(oldFiles) - 1; i >= 0; i-- {
+		name := oldFiles[i].Name()
+		fpath := filepath.Join(me.dir(), name)
+		if !me.isCompressed(name) {
+			if err := me.archiveBackup(tw, fpath, name, oldFiles[i].Size(), false); err != nil {
+				return err
+			}
+			continue
+		}
+		name = name[:len(name)-len(me.archiveExt(name))]
+		if uncompressed[name] {
+			continue
+		}
+		size, err := me.backupContentSize(fpath)
+		if err != nil {
+			return err
+		}
+		if err := me.archiveBackup(tw, fpath, name, size, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openLogfileSnapshot opens the logfile for reading and returns how many of
+// its bytes were written (and flushed) so far. It returns a nil file if there
+// is no logfile. The caller holds mu.
+func (me *Logger) openLogfileSnapshot() (*os.File, int64, error) {
+	if err := me.flush(); err != nil {
+		return nil, 0, err
+	}
+	f, err := openFileFn(me.fpath(), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't open log file for reading: %s", err)
+	}
+	size := me.size
+	if me.file == nil {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, fmt.Errorf("error getting log file info: %s", err)
+		}
+		size = info.Size()
+	}
+	return f, size, nil
+}
+
+// archiveFile adds the first size bytes of r to tw under the given name.
+func (me *Logger) archiveFile(tw *tar.Writer, r io.Reader, name string, size int64) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(me.fileMode()),
+		Size:    size,
+		ModTime: nowFn(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("can't write archive: %s", err)
+	}
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		return fmt.Errorf("can't archive %s: %s", name, err)
+	}
+	return nil
+}
+
+// archiveBackup adds the first size bytes of the (possibly compressed) archive
+// at fpath to tw under the given name.
+func (me *Logger) archiveBackup(tw *tar.Writer, fpath, name string, size int64, isCompressed bool) error {
+	var r io.ReadCloser
+	var err error
+	if isCompressed {
+		r, err = me.openBackup(fpath)
+		if err != nil {
+			return fmt.Errorf("can't decompress %s: %s", name, err)
+		}
+	} else {
+		r, err = os.Open(fpath)
+		if err != nil {
+			return fmt.Errorf("can't open %s: %s", name, err)
+		}
+	}
+	defer r.Close()
+	return me.archiveFile(tw, r, name, size)
+}
+
+// backupContentSize returns the original size of a compressed archive.
+func (me *Logger) backupContentSize(fpath string) (int64, error) {
+	r, err := me.openBackup(fpath)
+	if err != nil {
+		return 0, fmt.Errorf("can't decompress %s: %s", filepath.Base(fpath), err)
+	}
+	defer r.Close()
+	return io.Copy(ioutil.Discard, r)
+}
@@ -0,0 +1,101 @@
+package tumble
+
+import "fmt"
+
+// asyncMsg is a queued message, or if flushed is set, a marker which the
+// writer goroutine closes once every message queued before it is written.
+type asyncMsg struct {
+	buf     []byte
+	flushed chan struct{}
+}
+
+// writeAsync queues a copy of p for the writer goroutine. It reports that all
+// of p was written, as write errors can only be reported later (via OnError).
+// It returns false if the queue has been stopped, in which case the caller
+// should write synchronously.
+func (me *Logger) writeAsync(p []byte) bool {
+	me.asyncMu.RLock()
+	defer me.asyncMu.RUnlock()
+
+	if me.isAsyncStopped {
+		return false
+	}
+	me.startAsync()
+
+	buf := make([]byte, len(p))
+	copy(buf, p)
+
+	if !me.AsyncDrop {
+		me.asyncCh <- asyncMsg{buf: buf}
+		return true
+	}
+	select {
+	case me.asyncCh <- asyncMsg{buf: buf}:
+	default:
+		me.droppedMu.Lock()
+		me.dropped += 1
+		me.droppedMu.Unlock()
+	}
+	return true
+}
+
+// startAsync starts the writer goroutine, once. The caller holds asyncMu.
+func (me *Logger) startAsync() {
+	me.asyncOnce.Do(func() {
+		me.asyncCh = make(chan asyncMsg, me.AsyncQueue)
+		me.asyncWG.Add(1)
+		go me.asyncRun()
+	})
+}
+
+func (me *Logger) asyncRun() {
+	defer me.asyncWG.Done()
+	for msg := range me.asyncCh {
+		if msg.flushed != nil {
+			close(msg.flushed)
+			continue
+		}
+		if _, err := me.write(msg.buf); err != nil {
+			me.reportError("asyncRun", fmt.Errorf("can't write queued message: %w", err))
+		}
+	}
+}
+
+// waitAsync waits until the messages queued so far have been written (but
+// not necessarily flushed). The marker is never dropped, even with AsyncDrop.
+func (me *Logger) waitAsync() {
+	if me.AsyncQueue <= 0 {
+		return
+	}
+	me.asyncMu.RLock()
+	if me.isAsyncStopped {
+		me.asyncMu.RUnlock()
+		return
+	}
+	me.startAsync()
+	flushed := make(chan struct{})
+	me.asyncCh <- asyncMsg{flushed: flushed}
+	me.asyncMu.RUnlock()
+	<-flushed
+}
+
+// stopAsync stops the writer goroutine once the queue has been drained.
+// Any later writes are synchronous.
+func (me *Logger) stopAsync() {
+	me.asyncMu.Lock()
+	if !me.isAsyncStopped {
+		me.isAsyncStopped = true
+		if me.asyncCh != nil {
+			close(me.asyncCh)
+		}
+	}
+	me.asyncMu.Unlock()
+	me.asyncWG.Wait()
+}
+
+// Dropped returns the number of messages dropped because the AsyncQueue was full.
+func (me *Logger) Dropped() uint64 {
+	me.droppedMu.Lock()
+	defer me.droppedMu.Unlock()
+	return me.dropped
+}
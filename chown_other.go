@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package tumble
+
+import "os"
+
+// chown is a no-op where files don't have a uid and gid.
+func chown(name string, info os.FileInfo) error {
+	return nil
+}
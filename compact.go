@@ -0,0 +1,129 @@
+package tumble
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Compact merges all of the archives, from oldest to newest, into a single
+// compressed archive named after the oldest one, and removes the others.
+// This reduces the number of files (e.g. for long-idle archives). Note that
+// retention then applies to the merged archive as a whole. The mill is
+// paused meanwhile.
+func (me *Logger) Compact() error {
+	me.millMu.Lock()
+	defer me.millMu.Unlock()
+
+	oldFiles, err := me.oldLogFiles()
+	if err != nil {
+		return err
+	}
+
+	// An uncompressed archive takes precedence over a (partial) compressed one
+	uncompressed := make(map[string]bool)
+	for _, f := range oldFiles {
+		if !me.isCompressed(f.Name()) {
+			uncompressed[f.Name()] = true
+		}
+	}
+
+	// oldFiles is sorted from newest to oldest
+	sources := []string{}
+	for i := len(oldFiles) - 1; i >= 0; i-- {
+		name := oldFiles[i].Name()
+		if me.isCompressed(name) && uncompressed[name[:len(name)-len(me.archiveExt(name))]] {
+			continue
+		}
+		sources = append(sources, name)
+	}
+	if len(sources) < 2 {
+		return nil
+	}
+
+	base := sources[0]
+	if me.isCompressed(base) {
+		base = base[:len(base)-len(me.archiveExt(base))]
+	}
+	dst := filepath.Join(me.dir(), base+me.archiveSuffix())
+	if err := me.compactInto(dst, sources); err != nil {
+		return err
+	}
+
+	for _, f := range oldFiles {
+		fpath := filepath.Join(me.dir(), f.Name())
+		if fpath == dst {
+			continue
+		}
+		if err := os.Remove(fpath); err != nil {
+			return fmt.Errorf("can't remove backup: %s", err)
+		}
+	}
+	return nil
+}
+
+// compactInto writes the content of the given archives into a new compressed
+// archive at dst. It only replaces dst once the new archive is complete.
+func (me *Logger) compactInto(dst string, sources []string) (err error) {
+	tmp := dst + compressTmpSuffix
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, me.fileMode())
+	if err != nil {
+		return fmt.Errorf("can't open compacted archive: %s", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			err = fmt.Errorf("can't compact archives: %w", err)
+		}
+	}()
+
+	var w io.WriteCloser = f
+	if me.Encrypter != nil {
+		if w, err = me.Encrypter.NewWriter(f); err != nil {
+			return err
+		}
+	}
+	cw, err := me.compression().NewWriter(w)
+	if err != nil {
+		return err
+	}
+
+	buf := me.compressBuffer()
+	for _, name := range sources {
+		if err := me.compactFile(cw, filepath.Join(me.dir(), name), buf); err != nil {
+			return err
+		}
+	}
+
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if w != f {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// compactFile copies the original content of the archive at fpath to w.
+func (me *Logger) compactFile(w io.Writer, fpath string, buf []byte) error {
+	var r io.ReadCloser
+	var err error
+	if me.isCompressed(fpath) {
+		r, err = me.openBackup(fpath)
+	} else {
+		r, err = os.Open(fpath)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.CopyBuffer(w, struct{ io.Reader }{r}, buf)
+	return err
+}
@@ -0,0 +1,165 @@
+package tumble
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Compression compresses archives. The mill writes each archive through
+// NewWriter, and appends Extension to its name (e.g. ".gz").
+type Compression interface {
+	Extension() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// Decompressor reads archives written by the corresponding Compression.
+// Archives can only be read (e.g. by Muster, Archive or RepairOnStart)
+// if their Compression is also a Decompressor.
+type Decompressor interface {
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Gzip is the default Compression.
+type Gzip struct {
+	// Comment is stored in the gzip header of each archive.
+	Comment string
+
+	// Level is the compression level, from gzip.BestSpeed to
+	// gzip.BestCompression, or gzip.DefaultCompression. Zero also means
+	// gzip.DefaultCompression (rather than gzip.NoCompression).
+	Level int
+}
+
+func (me Gzip) Extension() string {
+	return compressSuffix
+}
+
+func (me Gzip) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	gz, err := gzip.NewWriterLevel(w, me.level())
+	if err != nil {
+		return nil, err
+	}
+	gz.Comment = me.Comment
+	return gz, nil
+}
+
+func (me Gzip) level() int {
+	if me.Level == 0 {
+		return gzip.DefaultCompression
+	}
+	return me.Level
+}
+
+// validateLevel rejects compression levels that gzip doesn't support.
+// Zero is allowed, and means gzip.DefaultCompression.
+func validateLevel(level int) error {
+	if level != 0 && level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+		return fmt.Errorf("invalid CompressLevel %d: must be between %d and %d, or %d", level, gzip.BestSpeed, gzip.BestCompression, gzip.DefaultCompression)
+	}
+	return nil
+}
+
+func (me Gzip) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// None leaves archives uncompressed. Unless they're encrypted, archives
+// keep the name they get on rotation.
+type None struct{}
+
+func (me None) Extension() string {
+	return ""
+}
+
+func (me None) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (me None) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+var (
+	compressionsMu sync.Mutex
+	compressions   = []Compression{Gzip{}}
+)
+
+// RegisterCompression makes archives written by c recognized (and readable,
+// if it's a Decompressor) by every Logger and Muster, whatever their own
+// Compression. This is useful after switching from one to another.
+// Gzip is always registered.
+func RegisterCompression(c Compression) {
+	compressionsMu.Lock()
+	defer compressionsMu.Unlock()
+	compressions = append(compressions, c)
+}
+
+// compressionFor returns the Compression with the given extension, going
+// by own (if any) and then the registered ones. Without an extension, it's None.
+func compressionFor(ext string, own Compression) (Compression, bool) {
+	if ext == "" {
+		return None{}, true
+	}
+	if own != nil && own.Extension() == ext {
+		return own, true
+	}
+	compressionsMu.Lock()
+	defer compressionsMu.Unlock()
+	for _, c := range compressions {
+		if c.Extension() == ext {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// compressionExt returns the longest extension that name ends with, going
+// by own (if any) and then the registered ones. If there's none, it's "".
+func compressionExt(name string, own Compression) string {
+	found := ""
+	match := func(c Compression) {
+		if ext := c.Extension(); len(ext) > len(found) && strings.HasSuffix(name, ext) {
+			found = ext
+		}
+	}
+	if own != nil {
+		match(own)
+	}
+	compressionsMu.Lock()
+	defer compressionsMu.Unlock()
+	for _, c := range compressions {
+		match(c)
+	}
+	return found
+}
+
+// errNoDecompressor is returned for archives that can't be decompressed,
+// since their Compression isn't a Decompressor (or isn't known).
+var errNoDecompressor = errors.New("Compression is not a Decompressor")
+
+// newDecompressReader decompresses r, which is an archive compressed with
+// the Compression with the given extension.
+func newDecompressReader(r io.Reader, ext string, own Compression) (io.ReadCloser, error) {
+	c, ok := compressionFor(ext, own)
+	if !ok {
+		return nil, errNoDecompressor
+	}
+	d, ok := c.(Decompressor)
+	if !ok {
+		return nil, errNoDecompressor
+	}
+	return d.NewReader(r)
+}
@@ -0,0 +1,188 @@
+package tumble
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypter encrypts compressed archives at rest. The mill writes the
+// compressed archive through NewWriter, and appends Suffix to its name
+// (e.g. "foo-1500000000.log.gz.aes").
+type Encrypter interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	Suffix() string
+}
+
+// Decrypter reads archives written by the corresponding Encrypter.
+// It is used by Muster to read encrypted archives.
+type Decrypter interface {
+	NewReader(r io.Reader) (io.Reader, error)
+	Suffix() string
+}
+
+const (
+	aesgcmSuffix     = ".aes"
+	aesgcmChunkSize  = 64 * 1024
+	aesgcmPrefixSize = 8
+	aesgcmFinalFlag  = 1 << 31
+)
+
+// AESGCM is an Encrypter and Decrypter using AES-GCM with a fixed key.
+//
+// The content is split into chunks of up to 64 KB, which are sealed
+// separately so that archives can be streamed. Each archive starts with
+// a random nonce prefix, and each chunk is preceded by its length. The
+// last chunk is flagged, so that a truncated archive is detected.
+type AESGCM struct {
+	aead cipher.AEAD
+}
+
+var _ Encrypter = (*AESGCM)(nil)
+var _ Decrypter = (*AESGCM)(nil)
+
+// NewAESGCM returns an AESGCM for the given key, which must be 16, 24 or
+// 32 bytes long (for AES-128, AES-192 or AES-256).
+func NewAESGCM(key []byte) (*AESGCM, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCM{aead}, nil
+}
+
+func (me *AESGCM) Suffix() string {
+	return aesgcmSuffix
+}
+
+func (me *AESGCM) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	wr := &aesgcmWriter{w: w, aead: me.aead}
+	if _, err := rand.Read(wr.prefix[:]); err != nil {
+		return nil, fmt.Errorf("can't generate nonce: %s", err)
+	}
+	if _, err := w.Write(wr.prefix[:]); err != nil {
+		return nil, err
+	}
+	return wr, nil
+}
+
+func (me *AESGCM) NewReader(r io.Reader) (io.Reader, error) {
+	rd := &aesgcmReader{r: r, aead: me.aead}
+	if _, err := io.ReadFull(r, rd.prefix[:]); err != nil {
+		return nil, fmt.Errorf("can't read nonce: %s", err)
+	}
+	return rd, nil
+}
+
+// aesgcmNonce returns the nonce of the given chunk.
+func aesgcmNonce(aead cipher.AEAD, prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], counter)
+	return nonce
+}
+
+// aesgcmWriter seals full chunks as they are written. The last chunk
+// (which may be empty) is sealed by Close.
+type aesgcmWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  [aesgcmPrefixSize]byte
+	counter uint32
+	buf     []byte
+}
+
+func (me *aesgcmWriter) Write(p []byte) (int, error) {
+	me.buf = append(me.buf, p...)
+	for len(me.buf) > aesgcmChunkSize {
+		if err := me.seal(me.buf[:aesgcmChunkSize], false); err != nil {
+			return 0, err
+		}
+		me.buf = me.buf[:copy(me.buf, me.buf[aesgcmChunkSize:])]
+	}
+	return len(p), nil
+}
+
+func (me *aesgcmWriter) Close() error {
+	return me.seal(me.buf, true)
+}
+
+func (me *aesgcmWriter) seal(chunk []byte, isFinal bool) error {
+	header := uint32(len(chunk) + me.aead.Overhead())
+	if isFinal {
+		header |= aesgcmFinalFlag
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], header)
+
+	sealed := me.aead.Seal(nil, aesgcmNonce(me.aead, me.prefix[:], me.counter), chunk, hdr[:])
+	me.counter++
+	if _, err := me.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := me.w.Write(sealed)
+	return err
+}
+
+// aesgcmReader opens one chunk at a time.
+type aesgcmReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  [aesgcmPrefixSize]byte
+	counter uint32
+	buf     []byte
+	isFinal bool
+}
+
+func (me *aesgcmReader) Read(p []byte) (int, error) {
+	for len(me.buf) == 0 {
+		if me.isFinal {
+			return 0, io.EOF
+		}
+		if err := me.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, me.buf)
+	me.buf = me.buf[n:]
+	return n, nil
+}
+
+func (me *aesgcmReader) open() error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(me.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("can't read encrypted chunk: %w", err)
+	}
+	header := binary.BigEndian.Uint32(hdr[:])
+	size := int(header &^ aesgcmFinalFlag)
+	if size < me.aead.Overhead() || size > aesgcmChunkSize+me.aead.Overhead() {
+		return errors.New("invalid encrypted chunk size")
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(me.r, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("can't read encrypted chunk: %w", err)
+	}
+	chunk, err := me.aead.Open(sealed[:0], aesgcmNonce(me.aead, me.prefix[:], me.counter), sealed, hdr[:])
+	if err != nil {
+		return fmt.Errorf("can't decrypt chunk: %w", err)
+	}
+	me.counter++
+	me.buf = chunk
+	me.isFinal = header&aesgcmFinalFlag != 0
+	return nil
+}
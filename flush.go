@@ -1,6 +1,11 @@
 package tumble
 
-import "io"
+import (
+	"bufio"
+	"io"
+	"os"
+	"time"
+)
 
 type FlusherError interface{ Flush() error }
 type FlusherVoid interface{ Flush() }
@@ -19,6 +24,96 @@ func Flush(wr io.Writer) error {
 	return nil
 }
 
+// Flush writes out the logfile's buffer, if any. With AsyncQueue, it first
+// waits for the messages queued before the call to be written.
 func (me *Logger) Flush() error {
+	me.waitAsync()
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.flush()
+}
+
+func (me *Logger) flush() error {
 	return Flush(me.file)
 }
+
+// Sync flushes the logfile and commits it to stable storage. With AsyncQueue,
+// it first waits for the messages queued before the call to be written.
+//
+// Together with Write, this makes Logger a zapcore.WriteSyncer, so it can be
+// used directly as a zap sink:
+//
+//     core := zapcore.NewCore(encoder, logger, zapcore.InfoLevel)
+//
+func (me *Logger) Sync() error {
+	me.waitAsync()
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if err := me.flush(); err != nil {
+		return err
+	}
+	if syncer, ok := me.file.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+const defaultWriteBufferSize = 64 * 1024
+
+// bufferedFile buffers writes to the logfile, for FlushInterval.
+type bufferedFile struct {
+	*bufio.Writer
+	f *os.File
+}
+
+func (me *bufferedFile) Close() error {
+	err := me.Writer.Flush()
+	if closeErr := me.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (me *bufferedFile) Sync() error {
+	return me.f.Sync()
+}
+
+// bufferFile returns the logfile to write to: f itself, or f with a buffer
+// if FlushInterval is set (in which case the flusher is started).
+func (me *Logger) bufferFile(f *os.File) io.WriteCloser {
+	if me.FlushInterval <= 0 {
+		return f
+	}
+	me.startFlusher()
+	return &bufferedFile{bufio.NewWriterSize(f, defaultWriteBufferSize), f}
+}
+
+// startFlusher starts the goroutine which flushes the logfile every
+// FlushInterval. It's stopped by StopMill.
+func (me *Logger) startFlusher() {
+	me.flushOnce.Do(func() {
+		me.flushStop = make(chan struct{})
+		me.millWG.Add(1)
+		go me.flushRun()
+	})
+}
+
+func (me *Logger) flushRun() {
+	defer me.millWG.Done()
+	ticker := time.NewTicker(me.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			me.mu.Lock()
+			err := me.flush()
+			me.mu.Unlock()
+			if err != nil {
+				me.reportError("flushRun", err)
+			}
+		case <-me.flushStop:
+			return
+		}
+	}
+}
@@ -2,7 +2,9 @@ package tumble
 
 import (
 	"io"
+	"os"
 	"sync"
+	"time"
 )
 
 // Logger is an io.WriteCloser which writes content to a rotating log archive.
@@ -10,7 +12,7 @@ import (
 // Parameters:
 //
 //     fpath:          Path to the logfile
-//     maxLogSizeMB:   Logfile size before it gets rotation (in MB)
+//     maxLogSizeMB:   Logfile size before it gets rotation (in MB, 0: 100 MB)
 //     maxTotalSizeMB: Total disk space of active log + compressed archives (in MB)
 //     formatFn:       Log message formatting function (optional)
 //
@@ -22,6 +24,14 @@ import (
 // where the msg begins. This is so the caller can calculate the correct
 // return value in the case of a write error.
 //
+// In other words, msgIdx is the number of prefix bytes added before msg,
+// i.e. the index in the returned buffer of the first byte of msg.
+// A successful Write returns (len(msg), nil), even if formatFn transforms
+// msg to a different length. If only n bytes of the buffer could be
+// written, Write returns n-msgIdx (clamped to [0, len(msg)]) with a non-nil
+// error (io.ErrShortWrite, unless the file returned another one), so any
+// prefix and suffix bytes don't count.
+//
 // Default formatting example:
 //
 //     log.SetFlags(log.LstdFlags | log.Lmicroseconds)
@@ -56,27 +66,484 @@ import (
 // Note: maxTotalSizeMB is not precise. It may be temporarily exceeded
 //       during rotation by the amount of MaxLogSizeMB.
 //
+// Filename is a legacy alias for Filepath, kept so that code written against
+// the Lumberjack-style Logger{Filename: ...} keeps compiling. When set, it
+// takes precedence over Filepath. It is deprecated and will be removed in a
+// future version.
+//
+// MaxSize, MaxBackups and MaxAge are the Lumberjack-named options, allowing
+// tumble to be used as a drop-in replacement by changing only the import path:
+//
+//     MaxSize:    Same as MaxLogSizeMB (in MB)
+//     MaxBackups: Maximum number of compressed archives to retain (0: no limit)
+//     MaxAge:     Maximum age of compressed archives to retain (in days, 0: no limit)
+//
+// Like Filename, MaxSize takes precedence over MaxLogSizeMB when set.
+// If neither is set, the logfile is rotated at 100 MB, as in Lumberjack.
+// Likewise, a zero maxLogSizeMB given to NewLogger means the default of 100 MB.
+// A zero MaxTotalSizeMB means there is no limit on total size.
+// Archives are removed as soon as any of the retention limits is exceeded.
+//
+// A Logger is safe for concurrent use (e.g. with log.SetOutput), but its
+// fields must be set before it's first written to. Writes are serialized by
+// a single lock, which is also held while rotating (including by the mill,
+// for MaxActiveAge), so a Write waits for any rotation in progress. With
+// Synchronous, that includes compressing and pruning the archives.
+//
 type Logger struct {
 	Filepath       string
+	Filename       string
 	MaxLogSizeMB   uint
 	MaxTotalSizeMB uint
 	FormatFn       func(msg []byte, buf []byte) ([]byte, int)
+	MaxSize        int
+	MaxBackups     int
+	MaxAge         int
+
+	// OnError receives errors from background work (such as compression in
+	// the mill) which has no caller to return them to. If nil, they are
+	// printed to stderr.
+	//
+	// It may be called while the write lock is held: from Write (when
+	// recovering from ENOSPC or EBADF, or enforcing MinFreeBytes), and while
+	// rotating. OnError must therefore not write to the same Logger (e.g.
+	// through a log.Logger set up with log.SetOutput), or it deadlocks.
+	OnError func(err error)
+
+	// TransformBackup, if set, processes a rotated logfile as it is
+	// compressed (e.g. to redact secrets). It reads the original content
+	// from src and writes the content to be archived to dst. If it fails,
+	// the original uncompressed backup is kept and the error is reported.
+	// The other archives are still compressed and subject to retention.
+	TransformBackup func(src io.Reader, dst io.Writer) error
+
+	// LowPriorityMill lowers the CPU and I/O priority of the mill, so that
+	// background compression doesn't compete with the main workload.
+	// It is only supported on Linux, and is a no-op elsewhere.
+	LowPriorityMill bool
+
+	// PreviousName, if set, keeps a copy of the most recently rotated
+	// logfile at Filepath+PreviousName (e.g. "foo.log.old"), in addition
+	// to the timestamped archive. It is overwritten on each rotation.
+	PreviousName string
+
+	// KeepNewestBackup exempts the newest archive from MaxTotalSizeMB, so
+	// that some history is retained even if MaxTotalSizeMB is set too small
+	// for a single compressed archive (which is reported via ErrBackupTooLarge).
+	KeepNewestBackup bool
+
+	// RetentionScanInterval, if set, makes the mill also run periodically
+	// rather than only on rotation, so that retention (e.g. MaxAge) is
+	// enforced while nothing is being logged. It takes effect once the mill
+	// has run for the first time (at the latest, on the first Write).
+	RetentionScanInterval time.Duration
+
+	// RotationSummary writes a line at the top of each new logfile with the
+	// size of the rotated logfile, how long it was written to, and its
+	// archive name. The line is counted towards the size of the new logfile.
+	RotationSummary bool
+
+	// GzipComment is stored in the header of each compressed archive
+	// (e.g. hostname or application version, for provenance), with the
+	// default Compression.
+	GzipComment string
+
+	// RepairOnStart reconciles the archives in the log directory (e.g. after
+	// a crash) before the logfile is first opened. See repair() for details.
+	RepairOnStart bool
+
+	// RotateEmptyFiles makes rotation archive the logfile even if it's empty.
+	// By default, rotating an empty logfile does nothing.
+	RotateEmptyFiles bool
+
+	// RotateOnStart archives an existing logfile when it's first opened, so
+	// that each run starts with a fresh logfile. Without it, an existing
+	// logfile is appended to, unless it has already reached the size limit.
+	RotateOnStart bool
+
+	// ShouldRotate, if set, is consulted before each write (in addition to
+	// the size limit) with the current logfile size and the time since it
+	// was opened. If it returns true, the logfile is rotated before writing.
+	ShouldRotate func(currentSize int64, sinceLastRotate time.Duration) bool
+
+	// AsyncQueue, if set, makes Write queue a copy of each message (up to
+	// AsyncQueue messages) and return immediately, while a dedicated goroutine
+	// formats and writes them, so Write isn't held up by rotation either.
+	// When the queue is full, Write blocks, or if AsyncDrop is set, drops
+	// the message (see Dropped). Errors are reported via OnError. Close
+	// writes out the queue before closing the logfile, and Flush and Sync
+	// wait for the messages queued before them.
+	AsyncQueue int
+	AsyncDrop  bool
+
+	// OpenFlags are added to the flags used to open the logfile, which are
+	// always O_WRONLY and O_CREATE plus O_APPEND or O_TRUNC (e.g. O_SYNC or
+	// O_NOATIME). See Validate for the flags which are not allowed.
+	OpenFlags int
+
+	// CompressBufferSize is the size of the buffer used to stream a logfile
+	// into compression (default: 32 KB). Compression never holds a whole
+	// logfile in memory, so this (plus the fixed-size gzip state) bounds
+	// the memory used by the mill.
+	CompressBufferSize int
+
+	// PreallocateActive reserves disk space for a full logfile (MaxLogSizeMB)
+	// whenever a new logfile is created, so that it can't run out of space
+	// later and is less fragmented. It is only supported on Linux, and is a
+	// no-op elsewhere.
+	PreallocateActive bool
+
+	// MillDeferRate, if set, is a write rate (in bytes/sec) above which the
+	// mill defers compression, so that it doesn't compete with logging for
+	// disk I/O during bursts. Retention still applies to compressed archives.
+	// Deferred compression is retried every second until the rate subsides.
+	MillDeferRate int64
+
+	// Diagnostics receives the logger's own operational messages, which
+	// can't go to the logfile: failures to open or rotate the logfile, and
+	// the background errors and recovery actions which aren't handled by
+	// OnError. It defaults to os.Stderr, and may be set to io.Discard.
+	Diagnostics io.Writer
+
+	// PostRotate, if set, is called by the mill with the path of each
+	// archive once it's compressed (like logrotate's postrotate). Likewise,
+	// ExecPostRotate is a command (argv) to be run with the path of the
+	// archive as an additional, last argument. Errors from either are
+	// reported, but don't affect logging. With Compression None{}, archives
+	// are final (and mirrored, with Mirror) once they're rotated.
+	PostRotate     func(backupPath string) error
+	ExecPostRotate []string
+
+	// Encrypter, if set, encrypts archives as they are compressed (see
+	// AESGCM). Its Suffix is appended to their names, and both encrypted
+	// and unencrypted archives are subject to retention. To read encrypted
+	// archives, set Muster's Decrypter.
+	Encrypter Encrypter
+
+	// Metrics, if set, receives the duration of each mill pass and the
+	// number of uncompressed archives waiting for the mill (see Stats).
+	Metrics Metrics
+
+	// CoalesceBackups makes the mill append each rotated logfile to the
+	// previous one while it's still uncompressed, until it reaches
+	// CoalesceSizeMB (default: 10 times MaxLogSizeMB). This gives fewer,
+	// better compressed archives when rotations are frequent. Meanwhile, the
+	// newest archive is left uncompressed (until Close), so Muster waits for it.
+	CoalesceBackups bool
+	CoalesceSizeMB  uint
+
+	// Synchronous runs the mill (compression and retention) inline whenever
+	// the logfile is opened or rotated, rather than in a background goroutine.
+	// Rotation then takes longer, but no goroutine is started. Periodic
+	// retention scans (RetentionScanInterval) don't apply in this mode.
+	Synchronous bool
+
+	// SequenceNumbers prepends a sequence number (and a space) to each record,
+	// before any formatting by FormatFn. It increases by one for each Write,
+	// across rotations, so that consumers can detect lost records. With
+	// SequenceSidecar, the last sequence number is saved next to the logfile
+	// (in Filepath+".seq") whenever it's closed or rotated, and numbering
+	// resumes from there on the next start. After a crash, it resumes from the
+	// last rotation, so some numbers may be repeated.
+	SequenceNumbers bool
+	SequenceSidecar bool
+
+	// MinFreeInodes, if set, is the number of inodes to keep free on the
+	// filesystem of the logfile. Before a new logfile is created, the oldest
+	// archives are removed (regardless of the retention limits) until it
+	// would leave enough inodes free, which is reported. It is only supported
+	// on Linux, and is a no-op elsewhere.
+	MinFreeInodes uint64
+
+	// BackupTimeFn, if set, provides the time in the name of each archive
+	// from the content of the rotated logfile, given its first and last
+	// records (lines). This allows backfilling historical logs into properly
+	// named archives. Retention (e.g. MaxAge) still goes by the current time.
+	// If it returns the zero time, the current time is used. Archives with
+	// the same time get a counter appended to it (e.g. "foo-1500000000.1.log").
+	BackupTimeFn func(firstRecord, lastRecord []byte) time.Time
+
+	// CompressDelay, if set, leaves archives uncompressed until they're older
+	// than this (going by the time in their name), so that consumers can
+	// still read recently rotated logfiles as plain text. Note that Muster
+	// waits for uncompressed archives to be compressed.
+	CompressDelay time.Duration
+
+	// ClockSkew determines what happens when the clock isn't later than
+	// the newest archive on rotation (by default, SkewBumpName).
+	ClockSkew ClockSkewPolicy
+
+	// Mirror is a list of additional directories (e.g. on other devices) to
+	// which each archive is copied once it's compressed. Failures to copy are
+	// reported, but don't affect logging. The retention limits apply to each
+	// mirror separately, unless MirrorLockstep is set, in which case archives
+	// are removed from the mirrors whenever they're removed from the log
+	// directory.
+	Mirror         []string
+	MirrorLockstep bool
+
+	// MaxActiveAge, if set, rotates the logfile once its content is older
+	// than this (counting from the first write to it), regardless of its
+	// size. This is checked on each write, and by the mill while nothing is
+	// being written. Empty logfiles are only rotated with RotateEmptyFiles
+	// (counting from when they were opened).
+	MaxActiveAge time.Duration
+
+	// TimestampResolution determines the layout of the time in archive names
+	// (by default, ResolutionSecond). Muster must be given the same one.
+	TimestampResolution TimestampResolution
+
+	// TriggerPolicy, if set, decides whether the logfile is rotated before
+	// each write, given the individual Triggers, instead of any one of them
+	// rotating it. For example, to avoid small archives when a burst briefly
+	// crosses the size limit:
+	//
+	//     func(tr Triggers) bool {
+	//         return tr.SizeExceeded && tr.Age >= time.Hour || tr.Age >= 24*time.Hour
+	//     }
+	//
+	// While nothing is being written, it's only consulted when MaxActiveAge
+	// is set (by the mill, as often as that's checked).
+	TriggerPolicy func(Triggers) bool
+
+	// OnRotatePaths, if set, is called on rotation as soon as the logfile
+	// has been renamed to oldBackup and recreated at newActive, so that
+	// tailing tools can reopen it right away. It's called while writes are
+	// blocked, so it must not write to the Logger.
+	OnRotatePaths func(oldBackup, newActive string)
 
-	file         io.WriteCloser
-	size         int64
-	millCh       chan struct{}
-	millWG       sync.WaitGroup
-	stopMillOnce sync.Once
-	fmtbuf       []byte
+	// CompressRetries is how many more times the mill tries to compress an
+	// archive when that fails (e.g. on a brief disk hiccup), rather than
+	// waiting for its next run. CompressBackoff is the delay before the
+	// first retry (by default, one second), which doubles each time. If all
+	// of them fail, the archive is left uncompressed and the error reported,
+	// and the mill goes on with the other archives and retention.
+	CompressRetries int
+	CompressBackoff time.Duration
+
+	// MaxLogAge, if set, rotates the logfile on the first write once it
+	// was created this long ago, regardless of its size (e.g. for a daily
+	// log). Unlike MaxActiveAge, it counts from when the logfile was
+	// created, which on restart is taken from the name of the newest archive.
+	MaxLogAge time.Duration
+
+	// BucketBy and PerBucketKeep, if set, keep only the newest PerBucketKeep
+	// archives of each day or hour (going by the time in their name), e.g.
+	// to keep one archive per day together with MaxAge. The other retention
+	// limits apply to the archives that are kept.
+	BucketBy      BucketPeriod
+	PerBucketKeep int
+
+	// WarmStandby opens the next logfile in advance (as Filepath+".standby"),
+	// so that rotation only has to rename it rather than create it. Another
+	// one is opened in the background after each rotation.
+	WarmStandby bool
+
+	// Compression compresses archives (by default, Gzip with GzipComment and
+	// CompressLevel).
+	// Archives written by the registered Compressions are also recognized
+	// (see RegisterCompression). Muster must be given the same one.
+	Compression Compression
+
+	// TimestampFormat, if set, is a time layout (e.g. "2006-01-02T15-04-05")
+	// for the time in archive names, in UTC, instead of TimestampResolution.
+	// It may not contain path separators or '.'. Archives that would get
+	// the same name get a counter instead (e.g. "foo-2017-07-14.1.log"), so
+	// they stay in order. Muster must be given the same one.
+	TimestampFormat string
+
+	// LocalTime formats the dates and times in archive names (with
+	// ResolutionDay or TimestampFormat) in the local time zone rather than
+	// UTC. Names still sort correctly when the clock is turned back for DST,
+	// since they never go backwards (see ClockSkew). Muster must be given
+	// the same setting.
+	LocalTime bool
+
+	// FlushInterval, if set, buffers writes to the logfile, which is flushed
+	// this often (and whenever it's rotated or closed). A crash can lose up
+	// to this much of the log, and write errors may only be reported by a
+	// later write or flush.
+	FlushInterval time.Duration
+
+	// OnRotate, if set, is called on its own goroutine after each rotation,
+	// with the path of the logfile and of the archive it was renamed to
+	// (which the mill may compress or remove in the meantime). Unlike
+	// OnRotatePaths, it never blocks writes.
+	OnRotate func(oldPath, newBackupPath string)
+
+	// OnCompress, if set, is called by the mill after it compresses each
+	// archive (after any CompressRetries), with the path of the compressed
+	// archive and the error, if compression failed. In that case, the
+	// archive is left uncompressed. With Compression None{}, it's called
+	// (with a nil error) for each archive once it's rotated.
+	OnCompress func(backupPath string, err error)
+
+	// Symlink, if set, is the path of a symlink which is kept pointing at
+	// the logfile, e.g. to make it reachable from another directory. It's
+	// updated atomically whenever the logfile is opened. If the path exists
+	// and is not a symlink, opening the logfile fails rather than replacing it.
+	Symlink string
+
+	// FileMode is the permissions of the logfile and its archives. It
+	// defaults to 0644.
+	FileMode os.FileMode
+
+	// DirMode is the permissions of the log directory, if it has to be
+	// created. It defaults to 0755.
+	DirMode os.FileMode
+
+	// CopyFileMetadata makes compressed archives keep the permissions of
+	// the archive they were compressed from (which are those of the
+	// logfile), as well as its owner and group where that's allowed.
+	CopyFileMetadata bool
+
+	// Header, if set, is called for each new logfile, and what it returns
+	// is written at the top of it, e.g. to describe the host and process.
+	// It's not written when appending to an existing logfile, unless that's
+	// empty. Until something else is written to it, a new logfile counts as
+	// empty (see RotateEmptyFiles).
+	Header func() []byte
+
+	// OnBytesWritten and OnRotateMetric, if set, are called after each
+	// write to the logfile (with the number of bytes written, including any
+	// formatting) and after each rotation, e.g. to add to metrics counters.
+	// They're called on the write path, while the Logger is locked, so they
+	// must be quick and must not block.
+	OnBytesWritten func(n int)
+	OnRotateMetric func()
+
+	// SubdirLayout, if set, puts archives in subdirectories of the log
+	// directory named by formatting their time with this layout (see
+	// time.Layout), e.g. "2006/01/02" for "2017/07/14/foo-1500000000.log.gz".
+	// Subdirectories are created with DirMode, and removed once expiry
+	// empties them. Muster and RepairOnStart only look at the log
+	// directory itself.
+	SubdirLayout string
+
+	// CompressLevel is the gzip level of archives with the default
+	// Compression, from gzip.BestSpeed to gzip.BestCompression. Zero means
+	// gzip.DefaultCompression; for no compression, use None instead.
+	// Other values are rejected by Validate.
+	CompressLevel int
+
+	// CompressWorkers is how many archives the mill compresses at once,
+	// e.g. to catch up on a backlog quicker. By default, it's one at a time.
+	// Everything else the mill does (e.g. retention) is still sequential.
+	CompressWorkers int
+
+	// MinFreeBytes, if set, is the disk space (in bytes) to keep free on the
+	// filesystem of the logfile. Before each write, the oldest archives are
+	// removed (regardless of the retention limits) until the write would
+	// leave enough space free, which is reported. If it still wouldn't,
+	// Write fails with ErrDiskFull rather than writing part of the message.
+	// Like MinFreeInodes, it is only supported on Linux.
+	MinFreeBytes int64
+
+	// MaxFmtBufCap, if set, is the capacity (in bytes) beyond which the
+	// buffers reused for formatting messages (e.g. by FormatFn) are released
+	// after a write, rather than kept for the next one. This keeps an
+	// occasional huge message from holding on to memory.
+	MaxFmtBufCap int
+
+	// OneFilePerWrite makes each Write (as formatted by FormatFn) its own
+	// archive, e.g. for audit events: the logfile is rotated after every
+	// write, and the archives are compressed and retained as usual. Writes
+	// within the same second get a counter (e.g. "foo-1500000000.1.log").
+	OneFilePerWrite bool
+
+	// mu serializes writes and rotation, and guards the logfile state below.
+	// It is taken before millMu, never after.
+	mu            sync.Mutex
+	file          io.WriteCloser
+	size          int64
+	millCh        chan struct{}
+	millMu        sync.Mutex
+	millWG        sync.WaitGroup
+	startMillOnce sync.Once
+	stopMillOnce  sync.Once
+	millChMu      sync.Mutex
+	isMillStopped bool
+	fmtbuf        []byte
+
+	openedAt       time.Time
+	fileStart      time.Time
+	isBudgetWarned bool
+	isRepaired     bool
+
+	asyncCh        chan asyncMsg
+	asyncMu        sync.RWMutex
+	asyncOnce      sync.Once
+	asyncWG        sync.WaitGroup
+	isAsyncStopped bool
+	droppedMu      sync.Mutex
+	dropped        uint64
+
+	rateMu         sync.Mutex
+	rateStart      time.Time
+	rateBytes      int64
+	rate           int64
+	isMillDeferred bool
+
+	statsMu     sync.Mutex
+	millBacklog int
+
+	isMillStopping  bool
+	abandonMu       sync.Mutex
+	isMillAbandoned bool
+
+	seq         uint64
+	seqbuf      []byte
+	isSeqLoaded bool
+
+	compressDue    time.Time
+	lastBackupTime time.Time
+
+	standbyMu        sync.Mutex
+	standbyWG        sync.WaitGroup
+	standby          *os.File
+	isStandbyPending bool
+
+	signalMu    sync.Mutex
+	signalStops []func()
+
+	flushOnce sync.Once
+	flushStop chan struct{}
+
+	errorsMu       sync.Mutex
+	errorsCh       chan error
+	isErrorsClosed bool
+
+	isRotatedOnStart bool
+	headerSize       int64
+	rotations        uint64
+	strbuf           []byte
+
+	finalizedMu sync.Mutex
+	finalized   []string
+}
+
+// BackupInfo describes an archived logfile.
+type BackupInfo struct {
+	Path      string
+	Timestamp time.Time
+	Size      int64
 }
 
 // Muster is an io.ReadCloser which produces the full history of
 // the given log file and its archives seamlessly and in order.
+//
+// Decrypter, if set, is used to read archives encrypted by Logger's Encrypter.
+// Only the archives with its Suffix are read.
 type Muster struct {
-	Filepath string
+	Filepath            string
+	Decrypter           Decrypter
+	TimestampResolution TimestampResolution
+	TimestampFormat     string
+	LocalTime           bool
+	Compression         Compression
 
-	latestTs           Timestamp
-	unreadyTs          Timestamp
+	latestKey          archiveKey
+	unreadyKey         archiveKey
 	openArchives       []io.Closer
 	archiveMultireader io.Reader
 	lastOpenFile       io.ReadCloser
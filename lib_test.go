@@ -3,12 +3,22 @@ package tumble
 // Note: Run tests sequentially (go test -parallel 1)
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -42,7 +52,7 @@ func TestOpenExisting(t *testing.T) {
 
 	filename := logFile(dir)
 	data := []byte("foo!")
-	err := ioutil.WriteFile(filename, data, fileMode)
+	err := ioutil.WriteFile(filename, data, defaultFileMode)
 	isNil(err, t)
 	existsWithContent(filename, data, t)
 
@@ -80,7 +90,7 @@ func TestFirstWriteRotate(t *testing.T) {
 
 	// this won't rotate
 	start := []byte("data")
-	err := ioutil.WriteFile(filename, start, fileMode)
+	err := ioutil.WriteFile(filename, start, defaultFileMode)
 	isNil(err, t)
 	existsWithContent(filename, start, t)
 
@@ -121,24 +131,24 @@ func TestCleanupExistingBackups(t *testing.T) {
 
 	data := []byte("data")
 	backup := backupFile(dir)
-	err := ioutil.WriteFile(backup+compressSuffix, data, fileMode)
+	err := ioutil.WriteFile(backup+compressSuffix, data, defaultFileMode)
 	isNil(err, t)
 
 	newFakeTime()
 
 	backup = backupFile(dir)
-	err = ioutil.WriteFile(backup+compressSuffix, data, fileMode)
+	err = ioutil.WriteFile(backup+compressSuffix, data, defaultFileMode)
 	isNil(err, t)
 
 	newFakeTime()
 
 	backup = backupFile(dir)
-	err = ioutil.WriteFile(backup+compressSuffix, data, fileMode)
+	err = ioutil.WriteFile(backup+compressSuffix, data, defaultFileMode)
 	isNil(err, t)
 
 	// now create a primary log file with some data
 	filename := logFile(dir)
-	err = ioutil.WriteFile(filename, data, fileMode)
+	err = ioutil.WriteFile(filename, data, defaultFileMode)
 	isNil(err, t)
 	l := NewLogger(
 		/* Filepath:       */ filename,
@@ -237,6 +247,7 @@ func TestRotate(t *testing.T) {
 		/* FormatFn:       */ nil,
 	)
 	defer l.Close()
+	l.RotateEmptyFiles = true
 	b := []byte("data")
 	n, err := l.Write(b)
 	isNil(err, t)
@@ -374,9 +385,9 @@ func TestCompressOnResume(t *testing.T) {
 	// Create a backup file and empty "compressed" file.
 	filename2 := backupFile(dir)
 	b := []byte("foo!")
-	err := ioutil.WriteFile(filename2, b, fileMode)
+	err := ioutil.WriteFile(filename2, b, defaultFileMode)
 	isNil(err, t)
-	err = ioutil.WriteFile(filename2+compressSuffix, []byte{}, fileMode)
+	err = ioutil.WriteFile(filename2+compressSuffix, []byte{}, defaultFileMode)
 	isNil(err, t)
 
 	newFakeTime()
@@ -402,6 +413,101 @@ func TestCompressOnResume(t *testing.T) {
 	fileCount(dir, 2, t)
 }
 
+func TestCompressedAlready(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestCompressedAlready", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	// A backup file and its complete compressed version, as if the mill
+	// was interrupted before removing the former
+	filename2 := backupFile(dir)
+	b := []byte("foo!")
+	err := ioutil.WriteFile(filename2, b, defaultFileMode)
+	isNil(err, t)
+	bc := new(bytes.Buffer)
+	gz := gzip.NewWriter(bc)
+	gz.Comment = "original"
+	_, err = gz.Write(b)
+	isNil(err, t)
+	err = gz.Close()
+	isNil(err, t)
+	err = ioutil.WriteFile(filename2+compressSuffix, bc.Bytes(), defaultFileMode)
+	isNil(err, t)
+
+	newFakeTime()
+	_, err = l.Write([]byte("boo!"))
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	// The backup file is removed rather than compressed again
+	existsWithContent(filename2+compressSuffix, bc.Bytes(), t)
+	notExist(filename2, t)
+	fileCount(dir, 2, t)
+}
+
+func TestCompressAtomic(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestCompressAtomic", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.OnError = func(err error) {}
+	l.Synchronous = true
+
+	// Compression fails midway, as if the process died. Until then, the
+	// archive only exists under a temporary name.
+	var isTmp, isFinal bool
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		_, err := os.Stat(backupFile(dir) + compressSuffix + compressTmpSuffix)
+		isTmp = err == nil
+		_, err = os.Stat(backupFile(dir) + compressSuffix)
+		isFinal = err == nil
+		return errors.New("killed")
+	}
+
+	b := []byte("boo!")
+	_, err := l.Write(b)
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	assert(isTmp, t, "expected a temporary archive during compression")
+	assert(!isFinal, t, "expected no archive during compression")
+
+	// No partial archive is left, and the backup file is kept
+	existsWithContent(backupFile(dir), b, t)
+	notExist(backupFile(dir)+compressSuffix, t)
+	notExist(backupFile(dir)+compressSuffix+compressTmpSuffix, t)
+
+	// It's compressed on the next try
+	l.TransformBackup = nil
+	err = l.millRunOnce()
+	isNil(err, t)
+	notExist(backupFile(dir), t)
+	exists(backupFile(dir)+compressSuffix, t)
+	fileCount(dir, 2, t)
+}
+
 func TestTimestampFormatFn(t *testing.T) {
 	dir := makeTempDir("TestTimestampFormatFn", t)
 	defer os.RemoveAll(dir)
@@ -656,3 +762,5034 @@ func TestDump(t *testing.T) {
 	isNil(scanner.Err(), t)
 	equals(2001+1, idx, t)
 }
+
+// appendingWriter writes to its logger every time it is written to,
+// simulating writes that happen while a copy is in progress.
+type appendingWriter struct {
+	buf    bytes.Buffer
+	logger *Logger
+}
+
+func (me *appendingWriter) Write(p []byte) (int, error) {
+	if _, err := me.logger.Write([]byte("more!")); err != nil {
+		return 0, err
+	}
+	return me.buf.Write(p)
+}
+
+func TestWriteTo(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestWriteTo", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	var buf bytes.Buffer
+	n, err := l.WriteTo(&buf)
+	isNil(err, t)
+	equals(int64(0), n, t)
+
+	b := []byte("boo!")
+	_, err = l.Write(b)
+	isNil(err, t)
+
+	w := &appendingWriter{logger: l}
+	n, err = l.WriteTo(w)
+	isNil(err, t)
+	equals(int64(len(b)), n, t)
+	equals(b, w.buf.Bytes(), t)
+
+	// The appended writes landed after the copied content
+	existsWithContent(filename, append(b, []byte("more!")...), t)
+
+	// A rotation as the logfile is opened for reading waits for the
+	// snapshot, and doesn't change what's copied
+	newFakeTime()
+	rotated := make(chan error, 1)
+	openFileFn = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		if flag == os.O_RDONLY {
+			go func() { rotated <- l.Rotate() }()
+			select {
+			case <-rotated:
+				t.Error("rotated between the snapshot and the open")
+			case <-time.After(sleepTime):
+			}
+		}
+		return os.OpenFile(name, flag, perm)
+	}
+	defer func() { openFileFn = os.OpenFile }()
+	buf.Reset()
+	n, err = l.WriteTo(&buf)
+	isNil(err, t)
+	equals(int64(len(b)+len("more!")), n, t)
+	equals(append(b, []byte("more!")...), buf.Bytes(), t)
+	isNil(<-rotated, t)
+	openFileFn = os.OpenFile
+	existsWithContent(filename, []byte{}, t)
+
+	// With writes (and rotations) from another goroutine, each copy is a
+	// run of whole records from a single logfile
+	filename2 := filepath.Join(dir, "concurrent.log")
+	l2 := NewLogger(
+		/* Filepath:       */ filename2,
+		/* MaxLogSizeMB:   */ 1 << 20,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l2.Close()
+	l2.FlushInterval = time.Hour
+	_, err = l2.Write([]byte("000000\n"))
+	isNil(err, t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i < 5000; i++ {
+			if i%1000 == 0 {
+				l2.Rotate()
+			}
+			l2.Write([]byte(fmt.Sprintf("%06d\n", i)))
+		}
+	}()
+	for isDone := false; !isDone; {
+		select {
+		case <-done:
+			isDone = true
+		default:
+		}
+		buf.Reset()
+		n, err := l2.WriteTo(&buf)
+		isNil(err, t)
+		equals(int64(buf.Len()), n, t)
+		equals(0, buf.Len()%7, t)
+		if buf.Len() == 0 {
+			continue
+		}
+		first, err := strconv.Atoi(string(buf.Bytes()[:6]))
+		isNil(err, t)
+		equals(0, first%1000, t)
+		for i := 0; i < buf.Len()/7; i++ {
+			equals(fmt.Sprintf("%06d\n", first+i), string(buf.Bytes()[i*7:i*7+7]), t)
+		}
+	}
+	equals(1000*7, buf.Len(), t)
+}
+
+func TestFilenameAlias(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestFilenameAlias", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := &Logger{
+		Filename:       filename,
+		MaxLogSizeMB:   10,
+		MaxTotalSizeMB: 50,
+	}
+	defer l.Close()
+	equals(filename, l.fpath(), t)
+
+	b := []byte("boo!")
+	n, err := l.Write(b)
+	isNil(err, t)
+	equals(len(b), n, t)
+	existsWithContent(filename, b, t)
+
+	newFakeTime()
+
+	err = l.rotate()
+	isNil(err, t)
+
+	time.Sleep(sleepTime)
+
+	bc := new(bytes.Buffer)
+	gz := gzip.NewWriter(bc)
+	_, err = gz.Write(b)
+	isNil(err, t)
+	err = gz.Close()
+	isNil(err, t)
+	existsWithContent(backupFile(dir)+compressSuffix, bc.Bytes(), t)
+	existsWithContent(filename, []byte{}, t)
+	fileCount(dir, 2, t)
+
+	// Filename takes precedence over Filepath
+	l2 := &Logger{Filepath: "/nonexistent/foo.log", Filename: filename}
+	defer l2.Close()
+	equals(filename, l2.fpath(), t)
+}
+
+func TestLumberjackFields(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestLumberjackFields", t)
+	defer os.RemoveAll(dir)
+
+	// make 3 backup files, 2 days apart
+	data := []byte("data")
+	for i := 0; i < 3; i++ {
+		newFakeTime()
+		err := ioutil.WriteFile(backupFile(dir)+compressSuffix, data, defaultFileMode)
+		isNil(err, t)
+	}
+	newestBackup := backupFile(dir) + compressSuffix
+
+	filename := logFile(dir)
+	err := ioutil.WriteFile(filename, data, defaultFileMode)
+	isNil(err, t)
+
+	// MaxBackups keeps only the 2 newest backups
+	l := &Logger{
+		Filename:   filename,
+		MaxSize:    10,
+		MaxBackups: 2,
+	}
+	defer l.Close()
+	equals(int64(10), l.maxLogSize(), t)
+
+	newFakeTime()
+
+	b := []byte("foooooo!")
+	n, err := l.Write(b)
+	isNil(err, t)
+	equals(len(b), n, t)
+
+	time.Sleep(sleepTime)
+
+	fileCount(dir, 3, t)
+	exists(newestBackup, t)
+	exists(backupFile(dir)+compressSuffix, t)
+
+	// MaxAge (in days) removes the newest-but-one backup, now 4 days old
+	err = l.Close()
+	isNil(err, t)
+	l2 := &Logger{
+		Filename: filename,
+		MaxSize:  10,
+		MaxAge:   3,
+	}
+	defer l2.Close()
+
+	newFakeTime()
+
+	err = l2.Rotate()
+	isNil(err, t)
+
+	time.Sleep(sleepTime)
+
+	fileCount(dir, 3, t)
+	notExist(newestBackup, t)
+}
+
+func TestTransformBackup(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestTransformBackup", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 10,
+		/* MaxTotalSizeMB: */ 50,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		b, err := ioutil.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		_, err = dst.Write(bytes.ToUpper(b))
+		return err
+	}
+
+	b := []byte("boo!")
+	_, err := l.Write(b)
+	isNil(err, t)
+
+	newFakeTime()
+
+	err = l.rotate()
+	isNil(err, t)
+
+	time.Sleep(sleepTime)
+
+	bc := new(bytes.Buffer)
+	gz := gzip.NewWriter(bc)
+	_, err = gz.Write([]byte("BOO!"))
+	isNil(err, t)
+	err = gz.Close()
+	isNil(err, t)
+	existsWithContent(backupFile(dir)+compressSuffix, bc.Bytes(), t)
+	notExist(backupFile(dir), t)
+
+	// A failing transform keeps the original and reports the error
+	errCh := make(chan error, 1)
+	l.OnError = func(err error) { errCh <- err }
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		return errors.New("transform failed")
+	}
+
+	_, err = l.Write(b)
+	isNil(err, t)
+
+	newFakeTime()
+
+	err = l.rotate()
+	isNil(err, t)
+
+	select {
+	case err = <-errCh:
+		notNil(err, t)
+	case <-time.After(time.Second):
+		t.Fatal("expected OnError to be called")
+	}
+	existsWithContent(backupFile(dir), b, t)
+	notExist(backupFile(dir)+compressSuffix, t)
+}
+
+func TestTransformBackupFailureRetention(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestTransformBackupFailureRetention", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Synchronous = true
+	l.MaxBackups = 1
+	var errs []error
+	l.OnError = func(err error) { errs = append(errs, err) }
+
+	// The transform always fails on "bad" content
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		b, err := ioutil.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(b, []byte("bad\n")) {
+			return errors.New("transform failed")
+		}
+		_, err = dst.Write(b)
+		return err
+	}
+
+	_, err := l.Write([]byte("bad\n"))
+	isNil(err, t)
+	newFakeTime()
+	bad := backupFile(dir)
+	err = l.rotate()
+	isNil(err, t)
+	equals(1, len(errs), t)
+
+	// The failing archive is kept uncompressed, and reported on each run,
+	// but the others are still compressed and pruned down to MaxBackups
+	var last string
+	for i := 0; i < 5; i++ {
+		_, err = l.Write([]byte("good\n"))
+		isNil(err, t)
+		newFakeTime()
+		last = backupFile(dir)
+		err = l.rotate()
+		isNil(err, t)
+	}
+	equals(6, len(errs), t)
+	existsWithContent(bad, []byte("bad\n"), t)
+	exists(last+compressSuffix, t)
+	// The logfile, the failing archive and the newest compressed one
+	fileCount(dir, 3, t)
+}
+
+func TestLowPriorityMill(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestLowPriorityMill", t)
+	defer os.RemoveAll(dir)
+
+	// The real thing must work on the current platform
+	errCh := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		errCh <- setLowPriority()
+	}()
+	isNil(<-errCh, t)
+
+	calls := 0
+	setLowPriorityFn = func() error {
+		calls += 1
+		return nil
+	}
+	defer func() { setLowPriorityFn = setLowPriority }()
+
+	l := NewLogger(
+		/* Filepath:       */ logFile(dir),
+		/* MaxLogSizeMB:   */ 10,
+		/* MaxTotalSizeMB: */ 50,
+		/* FormatFn:       */ nil,
+	)
+	l.LowPriorityMill = true
+
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+
+	err = l.Close()
+	isNil(err, t)
+	equals(1, calls, t)
+	exists(backupFile(dir)+compressSuffix, t)
+}
+
+func TestDeleteBackups(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestDeleteBackups", t)
+	defer os.RemoveAll(dir)
+
+	// make 4 backup files, 2 days apart
+	data := []byte("data")
+	backups := []string{}
+	times := []time.Time{}
+	for i := 0; i < 4; i++ {
+		newFakeTime()
+		backup := backupFile(dir) + compressSuffix
+		err := ioutil.WriteFile(backup, data, defaultFileMode)
+		isNil(err, t)
+		backups = append(backups, backup)
+		times = append(times, time.Unix(fakeTime().Unix(), 0).UTC())
+	}
+
+	l := NewLogger(
+		/* Filepath:       */ logFile(dir),
+		/* MaxLogSizeMB:   */ 10,
+		/* MaxTotalSizeMB: */ 50,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	// Delete the middle two
+	deleted, err := l.DeleteBackups(func(info BackupInfo) bool {
+		equals(int64(len(data)), info.Size, t)
+		return !info.Timestamp.Before(times[1]) && !info.Timestamp.After(times[2])
+	})
+	isNil(err, t)
+	equals([]string{backups[2], backups[1]}, deleted, t)
+
+	fileCount(dir, 2, t)
+	exists(backups[0], t)
+	exists(backups[3], t)
+}
+
+func TestOpenExistingGrown(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestOpenExistingGrown", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	data := []byte("foo!")
+	err := ioutil.WriteFile(filename, data, defaultFileMode)
+	isNil(err, t)
+
+	// Another writer appends between our Stat and our Open
+	grown := []byte("grown!")
+	openFileFn = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, perm)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(grown); err != nil {
+			return nil, err
+		}
+		f.Close()
+		return os.OpenFile(name, flag, perm)
+	}
+	defer func() { openFileFn = os.OpenFile }()
+
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	b := []byte("boo!")
+	_, err = l.Write(b)
+	isNil(err, t)
+
+	equals(int64(len(data)+len(grown)+len(b)), l.size, t)
+	existsWithContent(filename, []byte("foo!grown!boo!"), t)
+}
+
+func TestPreviousName(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestPreviousName", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 10,
+		/* MaxTotalSizeMB: */ 100,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.PreviousName = ".old"
+
+	for _, s := range []string{"one!", "two!"} {
+		b := []byte(s)
+		_, err := l.Write(b)
+		isNil(err, t)
+
+		newFakeTime()
+
+		err = l.rotate()
+		isNil(err, t)
+
+		time.Sleep(sleepTime)
+
+		existsWithContent(filename+".old", b, t)
+		exists(backupFile(dir)+compressSuffix, t)
+		notExist(backupFile(dir), t)
+	}
+	fileCount(dir, 4, t)
+}
+
+func TestBackupTooLarge(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestBackupTooLarge", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 10,
+		/* MaxTotalSizeMB: */ 20, /* gz files are between 23 and 29 bytes */
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	errCh := make(chan error, 10)
+	l.OnError = func(err error) { errCh <- err }
+
+	for i := 0; i < 2; i++ {
+		_, err := l.Write([]byte("boo!"))
+		isNil(err, t)
+		newFakeTime()
+		err = l.rotate()
+		isNil(err, t)
+		time.Sleep(sleepTime)
+
+		// Everything was deleted
+		fileCount(dir, 1, t)
+	}
+
+	// ...but we were only warned once
+	equals(1, len(errCh), t)
+	err := <-errCh
+	assert(errors.Is(err, ErrBackupTooLarge), t, "expected ErrBackupTooLarge, got %v", err)
+
+	// The newest archive can be kept regardless
+	err = l.Close()
+	isNil(err, t)
+	l = NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 10,
+		/* MaxTotalSizeMB: */ 20,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.OnError = func(err error) {}
+	l.KeepNewestBackup = true
+	_, err = l.Write([]byte("boo!"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	fileCount(dir, 2, t)
+	exists(backupFile(dir)+compressSuffix, t)
+}
+
+func TestRetentionScanInterval(t *testing.T) {
+	// The clock is read by the mill while the test moves it
+	var nowMu sync.Mutex
+	now := fakeTime()
+	nowFn = func() time.Time {
+		nowMu.Lock()
+		defer nowMu.Unlock()
+		return now
+	}
+	defer func() { nowFn = fakeTime }()
+	MB = 1
+
+	dir := makeTempDir("TestRetentionScanInterval", t)
+	defer os.RemoveAll(dir)
+
+	backup := backupFile(dir) + compressSuffix
+	err := ioutil.WriteFile(backup, []byte("data"), defaultFileMode)
+	isNil(err, t)
+
+	l := NewLogger(
+		/* Filepath:       */ logFile(dir),
+		/* MaxLogSizeMB:   */ 10,
+		/* MaxTotalSizeMB: */ 50,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.MaxAge = 3
+	l.RetentionScanInterval = 10 * time.Millisecond
+
+	_, err = l.Write([]byte("boo!"))
+	isNil(err, t)
+	time.Sleep(sleepTime)
+	exists(backup, t)
+
+	// Time passes, but nothing is written
+	nowMu.Lock()
+	now = now.Add(4 * 24 * time.Hour)
+	nowMu.Unlock()
+	time.Sleep(sleepTime)
+
+	notExist(backup, t)
+	fileCount(dir, 1, t)
+}
+
+func TestRotationSummary(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestRotationSummary", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 500,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.RotationSummary = true
+
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+
+	newFakeTime()
+
+	err = l.rotate()
+	isNil(err, t)
+
+	summary := fmt.Sprintf("tumble: rotated previous logfile (4 bytes) to %s after 48h0m0s\n", filepath.Base(backupFile(dir)))
+	existsWithContent(filename, []byte(summary), t)
+	equals(int64(len(summary)), l.size, t)
+
+	b := []byte("foo!")
+	_, err = l.Write(b)
+	isNil(err, t)
+	existsWithContent(filename, append([]byte(summary), b...), t)
+	equals(int64(len(summary)+len(b)), l.size, t)
+
+	// A logfile with nothing but the summary isn't archived
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+	fileCount(dir, 3, t)
+	for i := 0; i < 3; i++ {
+		newFakeTime()
+		err = l.Rotate()
+		isNil(err, t)
+	}
+	time.Sleep(sleepTime)
+	fileCount(dir, 3, t)
+}
+
+func TestGzipComment(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestGzipComment", t)
+	defer os.RemoveAll(dir)
+
+	l := NewLogger(
+		/* Filepath:       */ logFile(dir),
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 500,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.GzipComment = "host=foo version=1.2.3"
+
+	b := []byte("boo!")
+	_, err := l.Write(b)
+	isNil(err, t)
+
+	newFakeTime()
+
+	err = l.rotate()
+	isNil(err, t)
+
+	time.Sleep(sleepTime)
+
+	f, err := os.Open(backupFile(dir) + compressSuffix)
+	isNil(err, t)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	isNil(err, t)
+	equals("host=foo version=1.2.3", gz.Comment, t)
+	content, err := ioutil.ReadAll(gz)
+	isNil(err, t)
+	equals(b, content, t)
+}
+
+func TestRepairOnStart(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestRepairOnStart", t)
+	defer os.RemoveAll(dir)
+
+	data := []byte("data")
+
+	// An uncompressed archive
+	uncompressed := backupFile(dir)
+	err := ioutil.WriteFile(uncompressed, data, defaultFileMode)
+	isNil(err, t)
+	newFakeTime()
+
+	// An uncompressed archive with a partial compressed archive
+	partial := backupFile(dir)
+	err = ioutil.WriteFile(partial, data, defaultFileMode)
+	isNil(err, t)
+	err = ioutil.WriteFile(partial+compressSuffix, []byte{}, defaultFileMode)
+	isNil(err, t)
+	newFakeTime()
+
+	// A corrupt compressed archive
+	corrupt := backupFile(dir) + compressSuffix
+	err = ioutil.WriteFile(corrupt, data, defaultFileMode)
+	isNil(err, t)
+
+	// A temporary file left by an interrupted compression
+	leftover := backupFile(dir) + compressSuffix + compressTmpSuffix
+	err = ioutil.WriteFile(leftover, data, defaultFileMode)
+	isNil(err, t)
+
+	// An unrecognized file
+	unrecognized := filepath.Join(dir, "foobar-notes.log")
+	err = ioutil.WriteFile(unrecognized, data, defaultFileMode)
+	isNil(err, t)
+
+	l := NewLogger(
+		/* Filepath:       */ logFile(dir),
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 500,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	errCh := make(chan error, 10)
+	l.OnError = func(err error) { errCh <- err }
+	l.RepairOnStart = true
+
+	_, err = l.Write([]byte("boo!"))
+	isNil(err, t)
+
+	equals(5, len(errCh), t)
+
+	bc := new(bytes.Buffer)
+	gz := gzip.NewWriter(bc)
+	_, err = gz.Write(data)
+	isNil(err, t)
+	err = gz.Close()
+	isNil(err, t)
+	existsWithContent(uncompressed+compressSuffix, bc.Bytes(), t)
+	existsWithContent(partial+compressSuffix, bc.Bytes(), t)
+	notExist(uncompressed, t)
+	notExist(partial, t)
+	existsWithContent(corrupt+corruptSuffix, data, t)
+	notExist(corrupt, t)
+	existsWithContent(unrecognized, data, t)
+	notExist(leftover, t)
+
+	fileCount(dir, 5, t)
+}
+
+func TestRotateEmptyFiles(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestRotateEmptyFiles", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 500,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	b := []byte("boo!")
+	_, err := l.Write(b)
+	isNil(err, t)
+
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+	fileCount(dir, 2, t)
+
+	// The logfile is now empty, so this does nothing
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+	fileCount(dir, 2, t)
+	notExist(backupFile(dir)+compressSuffix, t)
+	existsWithContent(filename, []byte{}, t)
+}
+
+// syncCountingFile counts calls to Sync
+type syncCountingFile struct {
+	*os.File
+	syncs int
+}
+
+func (me *syncCountingFile) Sync() error {
+	me.syncs += 1
+	return me.File.Sync()
+}
+
+func TestSync(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestSync", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 6,
+		/* MaxTotalSizeMB: */ 50,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	// This is zapcore.WriteSyncer
+	var ws interface {
+		io.Writer
+		Sync() error
+	} = l
+
+	isNil(ws.Sync(), t)
+
+	b := []byte("boo!")
+	_, err := ws.Write(b)
+	isNil(err, t)
+
+	f := &syncCountingFile{File: l.file.(*os.File)}
+	l.file = f
+	isNil(ws.Sync(), t)
+	equals(1, f.syncs, t)
+
+	// This rotates
+	newFakeTime()
+	_, err = ws.Write(b)
+	isNil(err, t)
+	isNil(ws.Sync(), t)
+
+	time.Sleep(sleepTime)
+
+	existsWithContent(filename, b, t)
+	exists(backupFile(dir)+compressSuffix, t)
+}
+
+// noSpaceFile writes half of its input and fails with ENOSPC, a given number of times
+type noSpaceFile struct {
+	*os.File
+	fails int
+}
+
+func (me *noSpaceFile) Write(p []byte) (int, error) {
+	if me.fails == 0 {
+		return me.File.Write(p)
+	}
+	me.fails -= 1
+	n, err := me.File.Write(p[:len(p)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, syscall.ENOSPC
+}
+
+func TestNoSpace(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestNoSpace", t)
+	defer os.RemoveAll(dir)
+
+	data := []byte("data")
+	oldest := backupFile(dir) + compressSuffix
+	err := ioutil.WriteFile(oldest, data, defaultFileMode)
+	isNil(err, t)
+	newFakeTime()
+	newest := backupFile(dir) + compressSuffix
+	err = ioutil.WriteFile(newest, data, defaultFileMode)
+	isNil(err, t)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 500,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	errs := []error{}
+	l.OnError = func(err error) { errs = append(errs, err) }
+
+	b := []byte("boo!")
+	_, err = l.Write(b)
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	// The first failure frees up space, and the retry succeeds
+	f := &noSpaceFile{File: l.file.(*os.File), fails: 1}
+	l.file = f
+	n, err := l.Write([]byte("foo!"))
+	isNil(err, t)
+	equals(4, n, t)
+	existsWithContent(filename, []byte("boo!foo!"), t)
+	equals(int64(8), l.size, t)
+	notExist(oldest, t)
+	exists(newest, t)
+	equals(1, len(errs), t)
+
+	// Repeated failures leave only whole records
+	f.fails = 2
+	n, err = l.Write([]byte("bar!"))
+	assert(errors.Is(err, syscall.ENOSPC), t, "expected ENOSPC, got %v", err)
+	equals(0, n, t)
+	existsWithContent(filename, []byte("boo!foo!"), t)
+	equals(int64(8), l.size, t)
+	notExist(newest, t)
+	equals(3, len(errs), t)
+}
+
+func TestShouldRotate(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestShouldRotate", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 500,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	calls := 0
+	l.ShouldRotate = func(currentSize int64, sinceLastRotate time.Duration) bool {
+		calls += 1
+		equals(int64(4*((calls-1)%3+1)), currentSize, t)
+		equals(time.Duration((calls-1)%3+1)*48*time.Hour, sinceLastRotate, t)
+		return calls%3 == 0
+	}
+
+	b := []byte("boo!")
+	_, err := l.Write(b)
+	isNil(err, t)
+	for i := 0; i < 6; i++ {
+		newFakeTime()
+		_, err := l.Write(b)
+		isNil(err, t)
+	}
+	time.Sleep(sleepTime)
+
+	equals(6, calls, t)
+	fileCount(dir, 3, t)
+	existsWithContent(filename, b, t)
+}
+
+func TestAsyncQueue(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestAsyncQueue", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100000,
+		/* MaxTotalSizeMB: */ 500000,
+		/* FormatFn:       */ nil,
+	)
+	l.AsyncQueue = 10
+
+	// Everything is written in order, and the queue is drained on Close
+	expected := []byte{}
+	for i := 0; i < 1000; i++ {
+		b := []byte(fmt.Sprintf("line %d\n", i))
+		n, err := l.Write(b)
+		isNil(err, t)
+		equals(len(b), n, t)
+		expected = append(expected, b...)
+	}
+	err := l.Close()
+	isNil(err, t)
+	existsWithContent(filename, expected, t)
+	equals(uint64(0), l.Dropped(), t)
+}
+
+func TestAsyncQueueDrop(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestAsyncQueueDrop", t)
+	defer os.RemoveAll(dir)
+
+	// The writer goroutine is held up by the first message
+	startedCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	formatFn := func(msg []byte, buf []byte) ([]byte, int) {
+		if string(msg) == "first\n" {
+			close(startedCh)
+			<-releaseCh
+		}
+		return append(buf, msg...), 0
+	}
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 500,
+		/* FormatFn:       */ formatFn,
+	)
+	l.AsyncQueue = 2
+	l.AsyncDrop = true
+
+	_, err := l.Write([]byte("first\n"))
+	isNil(err, t)
+	<-startedCh
+	for i := 0; i < 5; i++ {
+		_, err := l.Write([]byte(fmt.Sprintf("line %d\n", i)))
+		isNil(err, t)
+	}
+	equals(uint64(3), l.Dropped(), t)
+
+	close(releaseCh)
+	err = l.Close()
+	isNil(err, t)
+	existsWithContent(filename, []byte("first\nline 0\nline 1\n"), t)
+}
+
+func TestAsyncQueueSync(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestAsyncQueueSync", t)
+	defer os.RemoveAll(dir)
+
+	// The writer goroutine is held up by the first message
+	startedCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	formatFn := func(msg []byte, buf []byte) ([]byte, int) {
+		if string(msg) == "first\n" {
+			close(startedCh)
+			<-releaseCh
+		}
+		return append(buf, msg...), 0
+	}
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 500,
+		/* FormatFn:       */ formatFn,
+	)
+	defer l.Close()
+	l.AsyncQueue = 2
+	l.FlushInterval = time.Hour
+
+	_, err := l.Write([]byte("first\n"))
+	isNil(err, t)
+	<-startedCh
+	for i := 0; i < 2; i++ {
+		_, err := l.Write([]byte(fmt.Sprintf("line %d\n", i)))
+		isNil(err, t)
+	}
+
+	// With the queue full, Sync waits for it to be written out
+	syncCh := make(chan error)
+	go func() { syncCh <- l.Sync() }()
+	select {
+	case <-syncCh:
+		t.Fatal("expected Sync to wait for the queue")
+	case <-time.After(sleepTime):
+	}
+	close(releaseCh)
+	isNil(<-syncCh, t)
+	existsWithContent(filename, []byte("first\nline 0\nline 1\n"), t)
+
+	// Likewise for Flush
+	_, err = l.Write([]byte("line 2\n"))
+	isNil(err, t)
+	err = l.Flush()
+	isNil(err, t)
+	existsWithContent(filename, []byte("first\nline 0\nline 1\nline 2\n"), t)
+}
+
+func TestAsyncQueueSlowRotation(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestAsyncQueueSlowRotation", t)
+	defer os.RemoveAll(dir)
+
+	// Each rotation takes a while
+	const renameDelay = 100 * time.Millisecond
+	renameFn = func(oldpath, newpath string) error {
+		time.Sleep(renameDelay)
+		return os.Rename(oldpath, newpath)
+	}
+	defer func() { renameFn = os.Rename }()
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 4000,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	l.AsyncQueue = 10000
+
+	// Producers aren't held up by rotations, as long as the queue has room
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var maxLatency time.Duration
+	for p := 0; p < 4; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				start := time.Now()
+				if _, err := l.Write([]byte(fmt.Sprintf("%d %04d\n", p, i))); err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if d := time.Since(start); d > maxLatency {
+					maxLatency = d
+				}
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	assert(maxLatency < renameDelay, t, "a write took %s", maxLatency)
+	err := l.Close()
+	isNil(err, t)
+	assert(l.rotations > 0, t, "expected rotations")
+
+	// Nothing is lost, and each producer's writes stay in order
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	next := make([]int, 4)
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		var p, i int
+		_, err := fmt.Sscanf(line, "%d %d", &p, &i)
+		isNil(err, t)
+		equals(next[p], i, t)
+		next[p]++
+	}
+	equals([]int{500, 500, 500, 500}, next, t)
+}
+
+func TestOpenFlags(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestOpenFlags", t)
+	defer os.RemoveAll(dir)
+
+	flags := []int{}
+	openFileFn = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		flags = append(flags, flag)
+		return os.OpenFile(name, flag, perm)
+	}
+	defer func() { openFileFn = os.OpenFile }()
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 500,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	l.OpenFlags = os.O_RDWR
+	notNil(l.Validate(), t)
+	_, err := l.Write([]byte("boo!"))
+	notNil(err, t)
+	equals(0, len(flags), t)
+
+	l.OpenFlags = os.O_SYNC
+	isNil(l.Validate(), t)
+
+	// New file
+	_, err = l.Write([]byte("boo!"))
+	isNil(err, t)
+	err = l.closeFile()
+	isNil(err, t)
+
+	// Existing file
+	_, err = l.Write([]byte("boo!"))
+	isNil(err, t)
+
+	equals([]int{
+		os.O_CREATE | os.O_WRONLY | os.O_TRUNC | os.O_SYNC,
+		os.O_APPEND | os.O_WRONLY | os.O_SYNC,
+	}, flags, t)
+	existsWithContent(filename, []byte("boo!boo!"), t)
+}
+
+func TestCompressMemory(t *testing.T) {
+	dir := makeTempDir("TestCompressMemory", t)
+	defer os.RemoveAll(dir)
+
+	l := &Logger{Filepath: logFile(dir), CompressBufferSize: 4096}
+
+	// compressAllocs returns the bytes allocated while compressing a file of the given size
+	compressAllocs := func(size int) uint64 {
+		src := backupFile(dir)
+		err := ioutil.WriteFile(src, bytes.Repeat([]byte("0123456789abcdef"), size/16), defaultFileMode)
+		isNil(err, t)
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		err = l.compressLogFile(src)
+		runtime.ReadMemStats(&after)
+		isNil(err, t)
+
+		os.Remove(src + compressSuffix)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+
+	small := compressAllocs(1024 * 1024)
+	large := compressAllocs(16 * 1024 * 1024)
+	assert(large < small+256*1024, t, "compressing 16 MB allocated %d bytes, but 1 MB only %d", large, small)
+}
+
+func TestPreallocateActive(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestPreallocateActive", t)
+	defer os.RemoveAll(dir)
+
+	// The real thing must work on the current platform, without changing the size
+	f, err := os.Create(filepath.Join(dir, "prealloc"))
+	isNil(err, t)
+	isNil(preallocate(f, 1024*1024), t)
+	info, err := f.Stat()
+	isNil(err, t)
+	equals(int64(0), info.Size(), t)
+	f.Close()
+	os.Remove(f.Name())
+
+	sizes := []int64{}
+	preallocateFn = func(f *os.File, size int64) error {
+		sizes = append(sizes, size)
+		return nil
+	}
+	defer func() { preallocateFn = preallocate }()
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 500,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.PreallocateActive = true
+
+	b := []byte("boo!")
+	_, err = l.Write(b)
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+
+	equals([]int64{100, 100}, sizes, t)
+	existsWithContent(filename, []byte{}, t)
+}
+
+func TestArchive(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestArchive", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 500,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	names := []string{}
+	for _, s := range []string{"one!", "two!"} {
+		_, err := l.Write([]byte(s))
+		isNil(err, t)
+		newFakeTime()
+		err = l.rotate()
+		isNil(err, t)
+		names = append(names, filepath.Base(backupFile(dir)))
+	}
+	_, err := l.Write([]byte("three!"))
+	isNil(err, t)
+	names = append(names, filepath.Base(filename))
+	time.Sleep(sleepTime)
+
+	dst := filepath.Join(dir, "bundle.tar.gz")
+	err = l.Archive(dst)
+	isNil(err, t)
+
+	f, err := os.Open(dst)
+	isNil(err, t)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	isNil(err, t)
+	tr := tar.NewReader(gz)
+
+	for i, s := range []string{"one!", "two!", "three!"} {
+		hdr, err := tr.Next()
+		isNil(err, t)
+		equals(names[i], hdr.Name, t)
+		content, err := ioutil.ReadAll(tr)
+		isNil(err, t)
+		equals(s, string(content), t)
+	}
+	_, err = tr.Next()
+	equals(io.EOF, err, t)
+}
+
+func TestArchiveWhileRotating(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestArchiveWhileRotating", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 70,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Compression = None{}
+
+	// The logfile is rotated every 10 records, so some rotations happen
+	// while archiving
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, err := l.Write([]byte(fmt.Sprintf("%06d\n", i)))
+			isNil(err, t)
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	dst := filepath.Join(dir, "bundle.tar.gz")
+	for i := 0; i < 20; i++ {
+		err := l.Archive(dst)
+		isNil(err, t)
+
+		f, err := os.Open(dst)
+		isNil(err, t)
+		gz, err := gzip.NewReader(f)
+		isNil(err, t)
+		tr := tar.NewReader(gz)
+		var content []byte
+		for {
+			_, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			isNil(err, t)
+			b, err := ioutil.ReadAll(tr)
+			isNil(err, t)
+			content = append(content, b...)
+		}
+		f.Close()
+
+		// No segment is lost or archived twice
+		if len(content)%7 != 0 {
+			t.Logf("%q", content)
+		}
+		equals(0, len(content)%7, t)
+		for j := 0; j < len(content)/7; j++ {
+			equals(fmt.Sprintf("%06d\n", j), string(content[j*7:j*7+7]), t)
+		}
+	}
+}
+
+func TestMillDeferRate(t *testing.T) {
+	// The clock is read by the mill while the test moves it
+	var nowMu sync.Mutex
+	now := fakeTime()
+	nowFn = func() time.Time {
+		nowMu.Lock()
+		defer nowMu.Unlock()
+		return now
+	}
+	defer func() { nowFn = fakeTime }()
+	advance := func(d time.Duration) {
+		nowMu.Lock()
+		now = now.Add(d)
+		nowMu.Unlock()
+	}
+	MB = 1
+	millDeferRetry = 10 * time.Millisecond
+	defer func() { millDeferRetry = time.Second }()
+
+	dir := makeTempDir("TestMillDeferRate", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 10000,
+		/* MaxTotalSizeMB: */ 50000,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.MillDeferRate = 100
+
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	// A burst of 1000 bytes in 1 second
+	_, err = l.Write(bytes.Repeat([]byte("x"), 1000))
+	isNil(err, t)
+	advance(time.Second)
+
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	// Compression was deferred
+	backup := filepath.Join(dir, fmt.Sprintf("foobar-%d.log", nowFn().Unix()))
+	exists(backup, t)
+	notExist(backup+compressSuffix, t)
+
+	// The burst is over, so compression catches up
+	advance(time.Hour)
+	time.Sleep(sleepTime)
+
+	notExist(backup, t)
+	exists(backup+compressSuffix, t)
+}
+
+func TestDiagnostics(t *testing.T) {
+	dir := makeTempDir("TestDiagnostics", t)
+	defer os.RemoveAll(dir)
+
+	openFileFn = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return nil, errors.New("forced failure")
+	}
+	defer func() { openFileFn = os.OpenFile }()
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	diagnostics := &bytes.Buffer{}
+	l.Diagnostics = diagnostics
+
+	_, err := l.Write([]byte("boo!"))
+	notNil(err, t)
+
+	equals("error in tumble/Write: can't open new logfile: forced failure\n", diagnostics.String(), t)
+}
+
+// shortWriteFile accepts up to limit bytes, then fails with io.ErrShortWrite
+type shortWriteFile struct {
+	limit int
+}
+
+func (me *shortWriteFile) Write(p []byte) (int, error) {
+	if me.limit < 0 || len(p) <= me.limit {
+		return len(p), nil
+	}
+	return me.limit, io.ErrShortWrite
+}
+
+func (me *shortWriteFile) Close() error {
+	return nil
+}
+
+func TestFormatFnConsumed(t *testing.T) {
+	prefix := func(msg []byte, buf []byte) ([]byte, int) {
+		buf = append(buf, "pre:"...)
+		return append(buf, msg...), 4
+	}
+	suffix := func(msg []byte, buf []byte) ([]byte, int) {
+		buf = append(buf, msg...)
+		return append(buf, ":suf"...), 0
+	}
+	both := func(msg []byte, buf []byte) ([]byte, int) {
+		buf = append(buf, "pre:"...)
+		buf = append(buf, msg...)
+		return append(buf, ":suf"...), 4
+	}
+	double := func(msg []byte, buf []byte) ([]byte, int) {
+		buf = append(buf, "pre:"...)
+		for _, c := range msg {
+			buf = append(buf, c, c)
+		}
+		return buf, 4
+	}
+
+	// The message is "boo!"
+	tests := []struct {
+		name     string
+		formatFn func(msg []byte, buf []byte) ([]byte, int)
+		limit    int
+		n        int
+	}{
+		{"prefix/complete", prefix, -1, 4},
+		{"prefix/none", prefix, 0, 0},
+		{"prefix/partial prefix", prefix, 2, 0},
+		{"prefix/whole prefix", prefix, 4, 0},
+		{"prefix/partial msg", prefix, 6, 2},
+		{"suffix/complete", suffix, -1, 4},
+		{"suffix/partial msg", suffix, 3, 3},
+		{"suffix/whole msg", suffix, 4, 4},
+		{"suffix/partial suffix", suffix, 6, 4},
+		{"both/complete", both, -1, 4},
+		{"both/partial prefix", both, 3, 0},
+		{"both/partial msg", both, 5, 1},
+		{"both/partial suffix", both, 10, 4},
+		{"transform/complete", double, -1, 4},
+		{"transform/partial prefix", double, 1, 0},
+		{"transform/partial msg", double, 7, 3},
+		{"transform/beyond msg", double, 11, 4},
+	}
+
+	for _, tt := range tests {
+		l := &Logger{FormatFn: tt.formatFn, file: &shortWriteFile{tt.limit}}
+		n, err := l.write([]byte("boo!"))
+		assert(tt.n == n, t, "%s: expected n=%d, got %d", tt.name, tt.n, n)
+		if tt.limit < 0 {
+			assert(err == nil, t, "%s: expected no error, got %v", tt.name, err)
+		} else {
+			assert(err == io.ErrShortWrite, t, "%s: expected io.ErrShortWrite, got %v", tt.name, err)
+		}
+	}
+}
+
+// chunkedFile writes at most limit bytes at a time, without an error,
+// breaking the io.Writer contract
+type chunkedFile struct {
+	io.WriteCloser
+	limit int
+}
+
+func (me *chunkedFile) Write(p []byte) (int, error) {
+	if len(p) > me.limit {
+		p = p[:me.limit]
+	}
+	return me.WriteCloser.Write(p)
+}
+
+func TestShortWriteRetried(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestShortWriteRetried", t)
+	defer os.RemoveAll(dir)
+
+	prefix := func(msg []byte, buf []byte) ([]byte, int) {
+		buf = append(buf, "pre:"...)
+		return append(buf, msg...), 4
+	}
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ prefix,
+	)
+	defer l.Close()
+
+	n, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+	equals(4, n, t)
+
+	// The rest of each formatted message is written, not dropped
+	l.file = &chunkedFile{l.file, 3}
+	n, err = l.Write([]byte("foooooo!"))
+	isNil(err, t)
+	equals(8, n, t)
+	n, err = l.Write([]byte("bar"))
+	isNil(err, t)
+	equals(3, n, t)
+	existsWithContent(filename, []byte("pre:boo!pre:foooooo!pre:bar"), t)
+	equals(int64(27), l.size, t)
+
+	// Without progress, the write fails
+	l.file = &chunkedFile{l.file, 0}
+	n, err = l.Write([]byte("baz"))
+	equals(0, n, t)
+	assert(err == io.ErrShortWrite, t, "expected io.ErrShortWrite, got %v", err)
+}
+
+// stallingFile writes half of its input and fails with ENOSPC, and then makes
+// no progress, without an error
+type stallingFile struct {
+	*os.File
+	isStalled bool
+}
+
+func (me *stallingFile) Write(p []byte) (int, error) {
+	if me.isStalled {
+		return 0, nil
+	}
+	me.isStalled = true
+	n, err := me.File.Write(p[:len(p)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, syscall.ENOSPC
+}
+
+func TestShortWriteOnRecovery(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestShortWriteOnRecovery", t)
+	defer os.RemoveAll(dir)
+
+	oldest := backupFile(dir) + compressSuffix
+	err := ioutil.WriteFile(oldest, []byte("data"), defaultFileMode)
+	isNil(err, t)
+	newFakeTime()
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.OnError = func(err error) {}
+
+	_, err = l.Write([]byte("boo!"))
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	// The retry after freeing up space writes the rest in chunks too
+	l.file = &chunkedFile{&noSpaceFile{File: l.file.(*os.File), fails: 1}, 3}
+	n, err := l.Write([]byte("foooooo!"))
+	isNil(err, t)
+	equals(8, n, t)
+	existsWithContent(filename, []byte("boo!foooooo!"), t)
+	equals(int64(12), l.size, t)
+	notExist(oldest, t)
+
+	// Without progress, the retry fails rather than dropping the rest
+	err = ioutil.WriteFile(oldest, []byte("data"), defaultFileMode)
+	isNil(err, t)
+	l.file = &stallingFile{File: l.file.(*chunkedFile).WriteCloser.(*noSpaceFile).File}
+	n, err = l.Write([]byte("bar!"))
+	assert(err == io.ErrShortWrite, t, "expected io.ErrShortWrite, got %v", err)
+	equals(0, n, t)
+	existsWithContent(filename, []byte("boo!foooooo!"), t)
+	equals(int64(12), l.size, t)
+}
+
+func TestRotateHeldFile(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestRotateHeldFile", t)
+	defer os.RemoveAll(dir)
+
+	// A reader holds the logfile, so it can't be renamed
+	renameFn = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errSharingViolation}
+	}
+	defer func() { renameFn = os.Rename }()
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	var errs []error
+	l.OnError = func(err error) { errs = append(errs, err) }
+
+	b := []byte("boo!")
+	_, err := l.Write(b)
+	isNil(err, t)
+
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	equals(1, len(errs), t)
+	assert(errors.Is(errs[0], errSharingViolation), t, "expected a sharing violation, got %v", errs[0])
+
+	b2 := []byte("foo!")
+	_, err = l.Write(b2)
+	isNil(err, t)
+	existsWithContent(filename, b2, t)
+
+	// The copy is compressed as usual
+	time.Sleep(sleepTime)
+	bc := new(bytes.Buffer)
+	gz := gzip.NewWriter(bc)
+	_, err = gz.Write(b)
+	isNil(err, t)
+	err = gz.Close()
+	isNil(err, t)
+	existsWithContent(backupFile(dir)+compressSuffix, bc.Bytes(), t)
+}
+
+func TestPostRotate(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestPostRotate", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	var mu sync.Mutex
+	var backups []string
+	l.PostRotate = func(backupPath string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		backups = append(backups, backupPath)
+		return nil
+	}
+	out := filepath.Join(dir, "postrotate.out")
+	if runtime.GOOS != "windows" {
+		l.ExecPostRotate = []string{"sh", "-c", `echo "$1" >> "$0"`, out}
+	}
+
+	expected := []string{}
+	for i := 0; i < 2; i++ {
+		_, err := l.Write([]byte("boo!"))
+		isNil(err, t)
+		newFakeTime()
+		expected = append(expected, backupFile(dir)+compressSuffix)
+		err = l.rotate()
+		isNil(err, t)
+		time.Sleep(sleepTime)
+	}
+
+	mu.Lock()
+	equals(expected, backups, t)
+	mu.Unlock()
+	if runtime.GOOS != "windows" {
+		existsWithContent(out, []byte(strings.Join(expected, "\n")+"\n"), t)
+	}
+}
+
+func TestEncrypter(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestEncrypter", t)
+	defer os.RemoveAll(dir)
+
+	encrypter, err := NewAESGCM(bytes.Repeat([]byte("k"), 32))
+	isNil(err, t)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 1000000,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Encrypter = encrypter
+
+	// More than one chunk
+	b := bytes.Repeat([]byte("boo!\n"), 30000)
+	_, err = l.Write(b)
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	b2 := []byte("foo!\n")
+	_, err = l.Write(b2)
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	backup := backupFile(dir) + compressSuffix + ".aes"
+	exists(backup, t)
+	notExist(backupFile(dir), t)
+	notExist(backupFile(dir)+compressSuffix, t)
+
+	// The archive isn't readable without decrypting it
+	data, err := ioutil.ReadFile(backup)
+	isNil(err, t)
+	assert(!bytes.Contains(data, []byte("boo!")), t, "expected encrypted content")
+
+	muster := NewMuster(filename)
+	muster.Decrypter = encrypter
+	content, err := ioutil.ReadAll(muster)
+	isNil(err, t)
+	equals(append(b, b2...), content, t)
+
+	// Tampering is detected
+	data[len(data)/2] ^= 1
+	err = ioutil.WriteFile(backup, data, defaultFileMode)
+	isNil(err, t)
+	muster = NewMuster(filename)
+	muster.Decrypter = encrypter
+	_, err = ioutil.ReadAll(muster)
+	notNil(err, t)
+}
+
+// millMetrics records the measurements of the mill
+type millMetrics struct {
+	mu         sync.Mutex
+	durations  []time.Duration
+	maxBacklog int
+}
+
+func (me *millMetrics) ObserveMillDuration(d time.Duration) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.durations = append(me.durations, d)
+}
+
+func (me *millMetrics) SetMillBacklog(n int) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if n > me.maxBacklog {
+		me.maxBacklog = n
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestMetrics", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	metrics := &millMetrics{}
+	l.Metrics = metrics
+
+	// A slow compressor can't keep up with rotation
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		time.Sleep(sleepTime)
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := l.Write([]byte("boo!"))
+		isNil(err, t)
+		newFakeTime()
+		err = l.rotate()
+		isNil(err, t)
+	}
+	time.Sleep(5 * sleepTime)
+	equals(0, l.Stats().MillBacklog, t)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	assert(metrics.maxBacklog >= 2, t, "expected a backlog of at least 2, got %d", metrics.maxBacklog)
+	assert(len(metrics.durations) > 0, t, "expected a mill pass")
+	for _, d := range metrics.durations {
+		assert(d > 0, t, "expected a positive duration, got %s", d)
+	}
+}
+
+func TestCoalesceBackups(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestCoalesceBackups", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 10,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	l.CoalesceBackups = true
+	l.CoalesceSizeMB = 30
+
+	// Each write rotates the previous one
+	expected := []byte{}
+	for i := 0; i < 8; i++ {
+		b := []byte(fmt.Sprintf("message %d\n", i))
+		newFakeTime()
+		_, err := l.Write(b)
+		isNil(err, t)
+		expected = append(expected, b...)
+	}
+	time.Sleep(sleepTime)
+
+	// Two full archives, and one pending archive
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(3, len(files), t)
+	equals(false, l.isCompressed(files[0].Name()), t)
+	equals(int64(10), files[0].Size(), t)
+	equals(true, l.isCompressed(files[1].Name()), t)
+	equals(true, l.isCompressed(files[2].Name()), t)
+
+	// The pending archive is compressed on Close
+	err = l.Close()
+	isNil(err, t)
+	files, err = l.oldLogFiles()
+	isNil(err, t)
+	equals(3, len(files), t)
+	equals(true, l.isCompressed(files[0].Name()), t)
+
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	equals(expected, content, t)
+}
+
+func TestSynchronous(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestSynchronous", t)
+	defer os.RemoveAll(dir)
+
+	goroutines := runtime.NumGoroutine()
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Synchronous = true
+
+	b := []byte("boo!")
+	_, err := l.Write(b)
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+
+	// The backup was compressed before rotate returned
+	notExist(backupFile(dir), t)
+	exists(backupFile(dir)+compressSuffix, t)
+	equals(goroutines, runtime.NumGoroutine(), t)
+
+	err = l.Close()
+	isNil(err, t)
+	equals(goroutines, runtime.NumGoroutine(), t)
+}
+
+func TestDiskUsage(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestDiskUsage", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.PreviousName = ".old"
+
+	usage, err := l.DiskUsage()
+	isNil(err, t)
+	equals(int64(0), usage, t)
+
+	for i := 0; i < 3; i++ {
+		_, err := l.Write([]byte("boo!"))
+		isNil(err, t)
+		newFakeTime()
+		err = l.rotate()
+		isNil(err, t)
+	}
+	_, err = l.Write([]byte("foo!"))
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	// Unrelated files aren't counted
+	err = ioutil.WriteFile(filepath.Join(dir, "unrelated.log"), []byte("unrelated"), defaultFileMode)
+	isNil(err, t)
+
+	files, err := ioutil.ReadDir(dir)
+	isNil(err, t)
+	expected := int64(0)
+	for _, f := range files {
+		if f.Name() != "unrelated.log" {
+			expected += f.Size()
+		}
+	}
+	equals(5, len(files)-1, t)
+
+	usage, err = l.DiskUsage()
+	isNil(err, t)
+	equals(expected, usage, t)
+}
+
+func TestReadOnlyDir(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestReadOnlyDir", t)
+	defer os.RemoveAll(dir)
+
+	// The directory is mounted read-only before the logfile is created
+	openFileFn = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EROFS}
+	}
+	defer func() { openFileFn = os.OpenFile }()
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Diagnostics = ioutil.Discard
+
+	_, err := l.Write([]byte("boo!"))
+	assert(errors.Is(err, ErrReadOnlyDir), t, "expected ErrReadOnlyDir, got %v", err)
+
+	// ... or after it was created, on rotation
+	openFileFn = os.OpenFile
+	_, err = l.Write([]byte("boo!"))
+	isNil(err, t)
+	renameFn = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EROFS}
+	}
+	defer func() { renameFn = os.Rename }()
+	err = l.rotate()
+	assert(errors.Is(err, ErrReadOnlyDir), t, "expected ErrReadOnlyDir, got %v", err)
+}
+
+func TestCloseContext(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestCloseContext", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ nil,
+	)
+	var errs []error
+	l.OnError = func(err error) { errs = append(errs, err) }
+
+	// A slow compressor which takes a second
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		buf := make([]byte, 1)
+		for {
+			time.Sleep(sleepTime / 10)
+			n, err := src.Read(buf)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+	}
+
+	b := bytes.Repeat([]byte("x"), 100)
+	_, err := l.Write(b)
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), sleepTime)
+	defer cancel()
+	start := time.Now()
+	err = l.CloseContext(ctx)
+	equals(context.DeadlineExceeded, err, t)
+	assert(time.Since(start) < 5*sleepTime, t, "expected a timely return, took %s", time.Since(start))
+
+	// The compression is abandoned, and the backup is kept for the next start
+	time.Sleep(sleepTime)
+	existsWithContent(backupFile(dir), b, t)
+	notExist(backupFile(dir)+compressSuffix, t)
+	equals(0, len(errs), t)
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestSequenceNumbers", t)
+	defer os.RemoveAll(dir)
+
+	formatFn := func(msg []byte, buf []byte) ([]byte, int) {
+		buf = append(buf, "> "...)
+		return append(buf, msg...), 2
+	}
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ formatFn,
+	)
+	defer l.Close()
+	l.SequenceNumbers = true
+	l.SequenceSidecar = true
+
+	for _, s := range []string{"a\n", "b\n"} {
+		n, err := l.Write([]byte(s))
+		isNil(err, t)
+		equals(len(s), n, t)
+	}
+	equals(int64(len("1 > a\n2 > b\n")), l.size, t)
+
+	newFakeTime()
+	err := l.rotate()
+	isNil(err, t)
+	_, err = l.Write([]byte("c\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("3 > c\n"), t)
+	time.Sleep(sleepTime)
+
+	// Numbering resumes after a restart
+	err = l.Close()
+	isNil(err, t)
+	existsWithContent(filename+seqSuffix, []byte("3\n"), t)
+
+	l = NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ formatFn,
+	)
+	defer l.Close()
+	l.SequenceNumbers = true
+	l.SequenceSidecar = true
+
+	_, err = l.Write([]byte("d\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("3 > c\n4 > d\n"), t)
+
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	equals("1 > a\n2 > b\n3 > c\n4 > d\n", string(content), t)
+}
+
+func TestMinFreeInodes(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestMinFreeInodes", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	var errs []error
+	l.OnError = func(err error) { errs = append(errs, err) }
+	l.MinFreeInodes = 10
+
+	// Each file in dir takes up one of 14 inodes
+	freeInodesFn = func(dir string) (uint64, error) {
+		files, err := ioutil.ReadDir(dir)
+		return uint64(14 - len(files)), err
+	}
+	defer func() { freeInodesFn = freeInodes }()
+
+	backups := []string{}
+	for i := 0; i < 3; i++ {
+		_, err := l.Write([]byte("boo!"))
+		isNil(err, t)
+		newFakeTime()
+		backups = append(backups, backupFile(dir)+compressSuffix)
+		err = l.rotate()
+		isNil(err, t)
+		time.Sleep(sleepTime)
+	}
+	equals(0, len(errs), t)
+
+	// The logfile and 3 backups leave exactly 10 inodes, so another backup
+	// makes room for itself by removing the oldest one
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	equals(1, len(errs), t)
+	notExist(backups[0], t)
+	exists(backups[1], t)
+	exists(backups[2], t)
+	exists(backupFile(dir)+compressSuffix, t)
+}
+
+func TestMinFreeBytes(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestMinFreeBytes", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	var errs []error
+	l.OnError = func(err error) { errs = append(errs, err) }
+	l.Diagnostics = ioutil.Discard
+	l.Compression = None{}
+	l.MinFreeBytes = 20
+
+	// The files in dir share a 100-byte disk
+	freeBytesFn = func(dir string) (uint64, error) {
+		files, err := ioutil.ReadDir(dir)
+		used := int64(0)
+		for _, f := range files {
+			used += f.Size()
+		}
+		return uint64(100 - used), err
+	}
+	defer func() { freeBytesFn = freeBytes }()
+
+	msg := bytes.Repeat([]byte("x"), 20)
+	backups := []string{}
+	for i := 0; i < 3; i++ {
+		_, err := l.Write(msg)
+		isNil(err, t)
+		newFakeTime()
+		backups = append(backups, backupFile(dir))
+		err = l.rotate()
+		isNil(err, t)
+	}
+	_, err := l.Write(msg)
+	isNil(err, t)
+	equals(0, len(errs), t)
+
+	// The next write makes room for itself by removing the oldest archive
+	_, err = l.Write([]byte("boo!"))
+	isNil(err, t)
+	equals(1, len(errs), t)
+	notExist(backups[0], t)
+	exists(backups[1], t)
+	exists(backups[2], t)
+
+	// A write that can't fit fails without writing anything
+	_, err = l.Write(bytes.Repeat([]byte("y"), 60))
+	equals(ErrDiskFull, err, t)
+	existsWithContent(filename, append(msg, "boo!"...), t)
+}
+
+func TestBackupTimeFn(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestBackupTimeFn", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	newLogger := func(maxAge int) *Logger {
+		l := NewLogger(
+			/* Filepath:       */ filename,
+			/* MaxLogSizeMB:   */ 100,
+			/* MaxTotalSizeMB: */ 0,
+			/* FormatFn:       */ nil,
+		)
+		l.MaxAge = maxAge
+		// Each record starts with its unix time
+		l.BackupTimeFn = func(firstRecord, lastRecord []byte) time.Time {
+			secs, err := strconv.ParseInt(strings.Fields(string(lastRecord))[0], 10, 64)
+			isNil(err, t)
+			return time.Unix(secs, 0)
+		}
+		return l
+	}
+	l := newLogger(0)
+	defer l.Close()
+
+	// Backfilled records are archived by their own time
+	_, err := l.Write([]byte("1500000000 first\n1500000100 last\n"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	backfilled := filepath.Join(dir, "foobar-1500000100.log"+compressSuffix)
+	exists(backfilled, t)
+	notExist(backupFile(dir)+compressSuffix, t)
+
+	// ... while retention goes by the current time
+	err = l.Close()
+	isNil(err, t)
+	l = newLogger(3)
+	defer l.Close()
+	_, err = l.Write([]byte(fmt.Sprintf("%d current\n", fakeTime().Unix())))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	notExist(backfilled, t)
+	exists(filepath.Join(dir, fmt.Sprintf("foobar-%d.log", fakeTime().Add(-48*time.Hour).Unix())+compressSuffix), t)
+}
+
+// badFile fails with EBADF, as if its device went away
+type badFile struct {
+	*os.File
+}
+
+func (me *badFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: me.Name(), Err: syscall.EBADF}
+}
+
+func TestReopenBadFile(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestReopenBadFile", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	var errs []error
+	l.OnError = func(err error) { errs = append(errs, err) }
+
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+
+	l.file = &badFile{l.file.(*os.File)}
+	n, err := l.Write([]byte("foo!"))
+	isNil(err, t)
+	equals(4, n, t)
+	equals(1, len(errs), t)
+	_, isReopened := l.file.(*os.File)
+	assert(isReopened, t, "expected the log file to be reopened")
+	existsWithContent(filename, []byte("boo!foo!"), t)
+	equals(int64(8), l.size, t)
+
+	// If the logfile can't be reopened, the write fails
+	l.file = &badFile{l.file.(*os.File)}
+	openFileFn = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EIO}
+	}
+	defer func() { openFileFn = os.OpenFile }()
+	_, err = l.Write([]byte("bar!"))
+	assert(errors.Is(err, syscall.EBADF), t, "expected EBADF, got %v", err)
+	equals(2, len(errs), t)
+}
+
+func TestCompressDelay(t *testing.T) {
+	// The clock is read by the mill while the test moves it
+	var nowMu sync.Mutex
+	now := fakeTime()
+	nowFn = func() time.Time {
+		nowMu.Lock()
+		defer nowMu.Unlock()
+		return now
+	}
+	defer func() { nowFn = fakeTime }()
+	advance := func(d time.Duration) {
+		nowMu.Lock()
+		now = now.Add(d)
+		nowMu.Unlock()
+	}
+	MB = 1
+
+	dir := makeTempDir("TestCompressDelay", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.CompressDelay = time.Hour
+
+	b := []byte("boo!")
+	_, err := l.Write(b)
+	isNil(err, t)
+	advance(48 * time.Hour)
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	// The fresh backup stays readable
+	backup := filepath.Join(dir, fmt.Sprintf("foobar-%d.log", nowFn().Unix()))
+	existsWithContent(backup, b, t)
+	notExist(backup+compressSuffix, t)
+
+	advance(30 * time.Minute)
+	l.mill()
+	time.Sleep(sleepTime)
+	exists(backup, t)
+	notExist(backup+compressSuffix, t)
+
+	// Once the delay has elapsed, the next mill pass compresses it
+	advance(30 * time.Minute)
+	l.mill()
+	time.Sleep(sleepTime)
+	notExist(backup, t)
+	exists(backup+compressSuffix, t)
+}
+
+func TestCurrentFileStart(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestCurrentFileStart", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 150,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	equals(true, l.CurrentFileStart().IsZero(), t)
+
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+	equals(fakeTime(), l.CurrentFileStart(), t)
+
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	equals(true, l.CurrentFileStart().IsZero(), t)
+
+	newFakeTime()
+	start := fakeTime()
+	_, err = l.Write([]byte("foo!"))
+	isNil(err, t)
+	newFakeTime()
+	_, err = l.Write([]byte("bar!"))
+	isNil(err, t)
+	equals(start, l.CurrentFileStart(), t)
+}
+
+func TestCompact(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestCompact", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	expected := []byte{}
+	oldest := ""
+	for i := 0; i < 4; i++ {
+		b := []byte(fmt.Sprintf("message %d\n", i))
+		_, err := l.Write(b)
+		isNil(err, t)
+		expected = append(expected, b...)
+		newFakeTime()
+		if oldest == "" {
+			oldest = backupFile(dir) + compressSuffix
+		}
+		err = l.rotate()
+		isNil(err, t)
+		time.Sleep(sleepTime)
+	}
+
+	// A backup that wasn't compressed yet is included as well
+	err := l.Close()
+	isNil(err, t)
+	l = NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.CompressDelay = time.Hour
+	b := []byte("message 4\n")
+	_, err = l.Write(b)
+	isNil(err, t)
+	expected = append(expected, b...)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+	exists(backupFile(dir), t)
+
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(5, len(files), t)
+
+	err = l.Compact()
+	isNil(err, t)
+
+	files, err = l.oldLogFiles()
+	isNil(err, t)
+	equals(1, len(files), t)
+	equals(filepath.Base(oldest), files[0].Name(), t)
+
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	equals(expected, content, t)
+}
+
+func TestClockSkew(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestClockSkew", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	_, err := l.Write([]byte("one\n"))
+	isNil(err, t)
+	newFakeTime()
+	first := backupFile(dir)
+	err = l.rotate()
+	isNil(err, t)
+
+	// The clock goes back an hour, so the next archive gets the time of the
+	// first, and a counter
+	fakeCurrentTime = fakeCurrentTime.Add(-time.Hour)
+	_, err = l.Write([]byte("two\n"))
+	isNil(err, t)
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	second := filepath.Join(dir, fmt.Sprintf("foobar-%d.1.log", fakeTime().Add(time.Hour).Unix()))
+	exists(first+compressSuffix, t)
+	exists(second+compressSuffix, t)
+
+	// Rotation can be deferred instead, until the clock catches up
+	l.ClockSkew = SkewDeferRotation
+	_, err = l.Write([]byte("three\n"))
+	isNil(err, t)
+	err = l.rotate()
+	isNil(err, t)
+	existsWithContent(filename, []byte("three\n"), t)
+
+	fakeCurrentTime = fakeCurrentTime.Add(time.Hour + 2*time.Second)
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+	exists(backupFile(dir)+compressSuffix, t)
+
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(3, len(files), t)
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	equals("one\ntwo\nthree\n", string(content), t)
+}
+
+func TestMirror(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestMirror", t)
+	defer os.RemoveAll(dir)
+	mirrors := []string{filepath.Join(dir, "mirror1"), filepath.Join(dir, "mirror2")}
+	for _, mirror := range mirrors {
+		err := os.Mkdir(mirror, 0700)
+		isNil(err, t)
+	}
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Mirror = mirrors
+	l.MaxBackups = 2
+
+	backups := []string{}
+	for i := 0; i < 3; i++ {
+		_, err := l.Write([]byte("boo!"))
+		isNil(err, t)
+		newFakeTime()
+		backups = append(backups, filepath.Base(backupFile(dir))+compressSuffix)
+		err = l.rotate()
+		isNil(err, t)
+		time.Sleep(sleepTime)
+	}
+
+	// Each mirror has the same archives, subject to the same retention
+	for _, d := range append([]string{dir}, mirrors...) {
+		notExist(filepath.Join(d, backups[0]), t)
+		exists(filepath.Join(d, backups[1]), t)
+		exists(filepath.Join(d, backups[2]), t)
+	}
+}
+
+func TestMaxActiveAge(t *testing.T) {
+	dir := makeTempDir("TestMaxActiveAge", t)
+	defer os.RemoveAll(dir)
+
+	// The clock is read by the mill while the test moves it
+	var nowMu sync.Mutex
+	now := fakeTime()
+	nowFn = func() time.Time {
+		nowMu.Lock()
+		defer nowMu.Unlock()
+		return now
+	}
+	defer func() { nowFn = fakeTime }()
+	advance := func(d time.Duration) {
+		nowMu.Lock()
+		now = now.Add(d)
+		nowMu.Unlock()
+	}
+	backup := func() string {
+		return filepath.Join(dir, fmt.Sprintf("foobar-%d.log", nowFn().Unix()))
+	}
+	MB = 1
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.MaxActiveAge = time.Hour
+
+	// Sparse writes
+	_, err := l.Write([]byte("one\n"))
+	isNil(err, t)
+	advance(30 * time.Minute)
+	_, err = l.Write([]byte("two\n"))
+	isNil(err, t)
+	advance(31 * time.Minute)
+	first := backup()
+	_, err = l.Write([]byte("three\n"))
+	isNil(err, t)
+	time.Sleep(sleepTime)
+
+	existsWithContent(filename, []byte("three\n"), t)
+	exists(first+compressSuffix, t)
+
+	// While idle, the mill rotates it
+	advance(59 * time.Minute)
+	l.mill()
+	time.Sleep(sleepTime)
+	existsWithContent(filename, []byte("three\n"), t)
+
+	advance(time.Minute)
+	second := backup()
+	l.mill()
+	time.Sleep(sleepTime)
+	existsWithContent(filename, []byte{}, t)
+	exists(second+compressSuffix, t)
+
+	// The empty logfile isn't rotated
+	advance(2 * time.Hour)
+	l.mill()
+	time.Sleep(sleepTime)
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(2, len(files), t)
+
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	equals("one\ntwo\nthree\n", string(content), t)
+}
+
+func TestTimestampResolution(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	for _, tt := range []struct {
+		resolution TimestampResolution
+		names      func(now time.Time) (string, string)
+	}{
+		{ResolutionSecond, func(now time.Time) (string, string) {
+			return fmt.Sprint(now.Unix()), fmt.Sprint(now.Unix()) + ".1"
+		}},
+		{ResolutionDay, func(now time.Time) (string, string) {
+			date := now.UTC().Format("2006-01-02")
+			return date, date + ".1"
+		}},
+		{ResolutionMillisecond, func(now time.Time) (string, string) {
+			ms := now.UnixNano() / int64(time.Millisecond)
+			return fmt.Sprint(ms), fmt.Sprint(ms) + ".1"
+		}},
+		{ResolutionNanosecond, func(now time.Time) (string, string) {
+			return fmt.Sprint(now.UnixNano()), fmt.Sprint(now.UnixNano() + 1)
+		}},
+	} {
+		dir := makeTempDir("TestTimestampResolution", t)
+		defer os.RemoveAll(dir)
+
+		filename := logFile(dir)
+		l := NewLogger(
+			/* Filepath:       */ filename,
+			/* MaxLogSizeMB:   */ 100,
+			/* MaxTotalSizeMB: */ 0,
+			/* FormatFn:       */ nil,
+		)
+		l.TimestampResolution = tt.resolution
+		newFakeTime()
+
+		// Both rotations happen at the same time, so the second archive
+		// gets a counter (or the next nanosecond)
+		_, err := l.Write([]byte("one\n"))
+		isNil(err, t)
+		err = l.rotate()
+		isNil(err, t)
+		_, err = l.Write([]byte("two\n"))
+		isNil(err, t)
+		err = l.rotate()
+		isNil(err, t)
+		_, err = l.Write([]byte("three\n"))
+		isNil(err, t)
+		err = l.Close()
+		isNil(err, t)
+
+		first, second := tt.names(fakeTime())
+		exists(filepath.Join(dir, "foobar-"+first+".log"+compressSuffix), t)
+		exists(filepath.Join(dir, "foobar-"+second+".log"+compressSuffix), t)
+
+		files, err := l.oldLogFiles()
+		isNil(err, t)
+		equals(2, len(files), t)
+		assert(files[0].timestamp.After(files[1].timestamp), t, "archives out of order")
+
+		muster := NewMuster(filename)
+		muster.TimestampResolution = tt.resolution
+		content, err := ioutil.ReadAll(muster)
+		isNil(err, t)
+		equals("one\ntwo\nthree\n", string(content), t)
+	}
+}
+
+func TestTriggerPolicy(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestTriggerPolicy", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 10,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.TriggerPolicy = func(tr Triggers) bool {
+		return tr.SizeExceeded && tr.Age >= time.Hour || tr.Age >= 24*time.Hour
+	}
+
+	// Crossing the size limit alone doesn't rotate
+	_, err := l.Write([]byte("aaaaaaaaa\n"))
+	isNil(err, t)
+	_, err = l.Write([]byte("b\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("aaaaaaaaa\nb\n"), t)
+
+	// ... but it does once the logfile is an hour old
+	newFakeTime()
+	fakeCurrentTime = fakeCurrentTime.Add(time.Hour)
+	first := backupFile(dir)
+	_, err = l.Write([]byte("c\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("c\n"), t)
+	time.Sleep(sleepTime)
+	exists(first+compressSuffix, t)
+
+	// A day-old logfile rotates regardless of its size
+	fakeCurrentTime = fakeCurrentTime.Add(23 * time.Hour)
+	_, err = l.Write([]byte("d\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("c\nd\n"), t)
+	fakeCurrentTime = fakeCurrentTime.Add(time.Hour)
+	second := backupFile(dir)
+	_, err = l.Write([]byte("e\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("e\n"), t)
+	time.Sleep(sleepTime)
+	exists(second+compressSuffix, t)
+
+	// The custom trigger can be combined too: rotate on request, but only
+	// once the write would take the logfile over 4 bytes
+	l.ShouldRotate = func(currentSize int64, sinceLastRotate time.Duration) bool {
+		return true
+	}
+	l.TriggerPolicy = func(tr Triggers) bool {
+		return tr.Custom && tr.Size > 4
+	}
+	_, err = l.Write([]byte("f\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("e\nf\n"), t)
+	fakeCurrentTime = fakeCurrentTime.Add(time.Second)
+	_, err = l.Write([]byte("g\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("g\n"), t)
+}
+
+func TestOnRotatePaths(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestOnRotatePaths", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	var oldBackup, newActive string
+	l.OnRotatePaths = func(old, active string) {
+		oldBackup, newActive = old, active
+		// The rename and the new logfile are in place already
+		exists(old, t)
+		existsWithContent(active, []byte{}, t)
+	}
+
+	// Opening the first logfile isn't a rotation
+	_, err := l.Write([]byte("foo\n"))
+	isNil(err, t)
+	equals("", oldBackup, t)
+
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	equals(backupFile(dir), oldBackup, t)
+	equals(filename, newActive, t)
+}
+
+func TestCompressRetries(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestCompressRetries", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Synchronous = true
+	l.CompressRetries = 2
+	l.CompressBackoff = time.Millisecond
+	l.MaxBackups = 1
+	var errs []error
+	l.OnError = func(err error) { errs = append(errs, err) }
+
+	// The transform fails twice, then succeeds on the last retry
+	attempts := 0
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		if attempts++; attempts <= 2 {
+			return errors.New("disk hiccup")
+		}
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	_, err := l.Write([]byte("foo\n"))
+	isNil(err, t)
+	newFakeTime()
+	first := backupFile(dir)
+	err = l.rotate()
+	isNil(err, t)
+	equals(3, attempts, t)
+	equals(0, len(errs), t)
+	notExist(first, t)
+	exists(first+compressSuffix, t)
+
+	// Persistent failures are reported, and the archive is left uncompressed
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		attempts++
+		return errors.New("disk failure")
+	}
+	attempts = 0
+	_, err = l.Write([]byte("bar\n"))
+	isNil(err, t)
+	fakeCurrentTime = fakeCurrentTime.Add(time.Second)
+	second := backupFile(dir)
+	err = l.rotate()
+	isNil(err, t)
+	equals(3, attempts, t)
+	equals(1, len(errs), t)
+	existsWithContent(second, []byte("bar\n"), t)
+	notExist(second+compressSuffix, t)
+
+	// Retention is still enforced on the other archives
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		b, err := ioutil.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(b, []byte("bar\n")) {
+			return errors.New("disk failure")
+		}
+		_, err = dst.Write(b)
+		return err
+	}
+	_, err = l.Write([]byte("baz\n"))
+	isNil(err, t)
+	fakeCurrentTime = fakeCurrentTime.Add(time.Second)
+	third := backupFile(dir)
+	err = l.rotate()
+	isNil(err, t)
+	equals(2, len(errs), t)
+	notExist(first+compressSuffix, t)
+	existsWithContent(second, []byte("bar\n"), t)
+	exists(third+compressSuffix, t)
+}
+
+func TestMaxLogAge(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestMaxLogAge", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	newLogger := func() *Logger {
+		l := NewLogger(
+			/* Filepath:       */ filename,
+			/* MaxLogSizeMB:   */ 100,
+			/* MaxTotalSizeMB: */ 0,
+			/* FormatFn:       */ nil,
+		)
+		l.MaxLogAge = 24 * time.Hour
+		return l
+	}
+	l := newLogger()
+	defer l.Close()
+
+	newFakeTime()
+	_, err := l.Write([]byte("a\n"))
+	isNil(err, t)
+	fakeCurrentTime = fakeCurrentTime.Add(23 * time.Hour)
+	_, err = l.Write([]byte("b\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("a\nb\n"), t)
+
+	// A day after the logfile was created, it's rotated regardless of size
+	fakeCurrentTime = fakeCurrentTime.Add(time.Hour)
+	first := backupFile(dir)
+	_, err = l.Write([]byte("c\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("c\n"), t)
+	err = l.Close()
+	isNil(err, t)
+	exists(first+compressSuffix, t)
+
+	// Restarts don't reset the age of the logfile
+	fakeCurrentTime = fakeCurrentTime.Add(23 * time.Hour)
+	l = newLogger()
+	_, err = l.Write([]byte("d\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("c\nd\n"), t)
+	err = l.Close()
+	isNil(err, t)
+
+	fakeCurrentTime = fakeCurrentTime.Add(time.Hour)
+	second := backupFile(dir)
+	l = newLogger()
+	_, err = l.Write([]byte("e\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("e\n"), t)
+	err = l.Close()
+	isNil(err, t)
+
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	equals("a\nb\nc\nd\ne\n", string(content), t)
+	exists(second+compressSuffix, t)
+}
+
+func TestPerBucketKeep(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestPerBucketKeep", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Synchronous = true
+	l.BucketBy = BucketDay
+	l.PerBucketKeep = 1
+	l.MaxAge = 2
+
+	// Three archives a day for four days
+	newFakeTime()
+	start := fakeCurrentTime.UTC().Truncate(24 * time.Hour)
+	for day := 0; day < 4; day++ {
+		for hour := 1; hour <= 3; hour++ {
+			fakeCurrentTime = start.Add(time.Duration(day)*24*time.Hour + time.Duration(hour)*time.Hour)
+			_, err := l.Write([]byte("foo\n"))
+			isNil(err, t)
+			err = l.rotate()
+			isNil(err, t)
+		}
+	}
+
+	// Only the newest of each day is kept, and only for the last two days
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(3, len(files), t)
+	for i, f := range files {
+		exp := start.Add(time.Duration(3-i)*24*time.Hour + 3*time.Hour)
+		equals(fmt.Sprintf("foobar-%d.log%s", exp.Unix(), compressSuffix), f.Name(), t)
+	}
+}
+
+func TestWarmStandby(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestWarmStandby", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.WarmStandby = true
+
+	_, err := l.Write([]byte("one\n"))
+	isNil(err, t)
+	for _, line := range []string{"two\n", "three\n"} {
+		l.standbyWG.Wait()
+		standby, err := os.Stat(filename + standbySuffix)
+		isNil(err, t)
+
+		// Rotation swaps in the standby logfile, with nothing lost
+		newFakeTime()
+		err = l.rotate()
+		isNil(err, t)
+		active, err := os.Stat(filename)
+		isNil(err, t)
+		assert(os.SameFile(standby, active), t, "standby logfile wasn't used")
+		_, err = l.Write([]byte(line))
+		isNil(err, t)
+	}
+
+	err = l.Close()
+	isNil(err, t)
+	notExist(filename+standbySuffix, t)
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	equals("one\ntwo\nthree\n", string(content), t)
+}
+
+func BenchmarkRotate(b *testing.B) {
+	for _, isWarmStandby := range []bool{false, true} {
+		b.Run(fmt.Sprintf("WarmStandby=%v", isWarmStandby), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "BenchmarkRotate")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			l := NewLogger(
+				/* Filepath:       */ filepath.Join(dir, "foobar.log"),
+				/* MaxLogSizeMB:   */ 100,
+				/* MaxTotalSizeMB: */ 0,
+				/* FormatFn:       */ nil,
+			)
+			defer l.Close()
+			l.WarmStandby = isWarmStandby
+			l.CompressDelay = time.Hour
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if _, err := l.Write([]byte("foo\n")); err != nil {
+					b.Fatal(err)
+				}
+				l.standbyWG.Wait()
+				b.StartTimer()
+				if err := l.rotate(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestConcurrentWrites", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100000,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.FormatFn = func(msg []byte, buf []byte) ([]byte, int) {
+		buf = append(buf, "> "...)
+		return append(buf, msg...), 2
+	}
+
+	// Rotations happen as writes race each other
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			line := []byte(fmt.Sprintf("writer %02d\n", i))
+			for j := 0; j < 1000; j++ {
+				if _, err := l.Write(line); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	err := l.Close()
+	isNil(err, t)
+
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	equals(50*1000*len("> writer 00\n"), len(content), t)
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if line != "" && (len(line) != len("> writer 00\n") || !strings.HasPrefix(line, "> writer ")) {
+			t.Fatalf("corrupted line: %q", line)
+		}
+	}
+}
+
+func TestConcurrentFirstWrites(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestConcurrentFirstWrites", t)
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	opens := 0
+	openFileFn = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		mu.Lock()
+		opens++
+		mu.Unlock()
+		return os.OpenFile(name, flag, perm)
+	}
+	defer func() { openFileFn = os.OpenFile }()
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100000,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	// All of the very first writes are let go at once
+	startCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-startCh
+			if _, err := l.Write([]byte(fmt.Sprintf("writer %02d\n", i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	close(startCh)
+	wg.Wait()
+
+	// The logfile was opened once, and holds every write
+	equals(1, opens, t)
+	fileCount(dir, 1, t)
+	content, err := ioutil.ReadFile(filename)
+	isNil(err, t)
+	equals(50*len("writer 00\n"), len(content), t)
+	equals(int64(len(content)), l.size, t)
+	for i := 0; i < 50; i++ {
+		assert(bytes.Contains(content, []byte(fmt.Sprintf("writer %02d\n", i))), t, "missing write %d", i)
+	}
+}
+
+// xorCompression is a trivial Compression (and Decompressor) for testing.
+type xorCompression struct{}
+
+func (xorCompression) Extension() string {
+	return ".xor"
+}
+
+func (xorCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{xorWriter{w}}, nil
+}
+
+func (xorCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(xorReader{r}), nil
+}
+
+type xorWriter struct{ w io.Writer }
+
+func (me xorWriter) Write(p []byte) (int, error) {
+	return me.w.Write(bytes.Map(func(r rune) rune { return r ^ 0x20 }, p))
+}
+
+type xorReader struct{ r io.Reader }
+
+func (me xorReader) Read(p []byte) (int, error) {
+	n, err := me.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= 0x20
+	}
+	return n, err
+}
+
+func TestCompression(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestCompression", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Synchronous = true
+
+	// By default, archives are gzipped
+	_, err := l.Write([]byte("one\n"))
+	isNil(err, t)
+	newFakeTime()
+	first := backupFile(dir)
+	err = l.rotate()
+	isNil(err, t)
+	exists(first+compressSuffix, t)
+
+	// The archive name follows the Compression
+	l.Compression = xorCompression{}
+	_, err = l.Write([]byte("two\n"))
+	isNil(err, t)
+	fakeCurrentTime = fakeCurrentTime.Add(time.Second)
+	second := backupFile(dir)
+	err = l.rotate()
+	isNil(err, t)
+	existsWithContent(second+".xor", []byte("TWO*"), t)
+
+	// Without compression, archives keep their names
+	l.Compression = None{}
+	_, err = l.Write([]byte("three\n"))
+	isNil(err, t)
+	fakeCurrentTime = fakeCurrentTime.Add(time.Second)
+	third := backupFile(dir)
+	err = l.rotate()
+	isNil(err, t)
+	existsWithContent(third, []byte("three\n"), t)
+
+	// Archives of other registered Compressions are still recognized
+	RegisterCompression(xorCompression{})
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(3, len(files), t)
+	for _, f := range files {
+		assert(l.isCompressed(f.Name()), t, "archive %s isn't recognized as compressed", f.Name())
+	}
+	r, err := l.openBackup(second + ".xor")
+	isNil(err, t)
+	b, err := ioutil.ReadAll(r)
+	isNil(err, t)
+	r.Close()
+	equals("two\n", string(b), t)
+
+	// Muster reads the archives of its Compression
+	l.Compression = xorCompression{}
+	_, err = l.Write([]byte("four\n"))
+	isNil(err, t)
+	err = l.Close()
+	isNil(err, t)
+	err = os.Remove(first + compressSuffix)
+	isNil(err, t)
+	err = os.Remove(third)
+	isNil(err, t)
+	muster := NewMuster(filename)
+	muster.Compression = xorCompression{}
+	content, err := ioutil.ReadAll(muster)
+	isNil(err, t)
+	equals("two\nfour\n", string(content), t)
+}
+
+func TestRotateExported(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestRotateExported", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	// Without anything written, there's nothing to archive
+	err := l.Rotate()
+	isNil(err, t)
+	existsWithContent(filename, []byte{}, t)
+	fileCount(dir, 1, t)
+
+	_, err = l.Write([]byte("foo\n"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.Rotate()
+	isNil(err, t)
+	existsWithContent(filename, []byte{}, t)
+	time.Sleep(sleepTime)
+	exists(backupFile(dir)+compressSuffix, t)
+
+	// A logfile left from before is opened and archived
+	err = l.Close()
+	isNil(err, t)
+	err = ioutil.WriteFile(filename, []byte("bar\n"), 0644)
+	isNil(err, t)
+	l = NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	fakeCurrentTime = fakeCurrentTime.Add(time.Second)
+	err = l.Rotate()
+	isNil(err, t)
+	existsWithContent(filename, []byte{}, t)
+	time.Sleep(sleepTime)
+	exists(backupFile(dir)+compressSuffix, t)
+}
+
+func TestRotateOnSignal(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestRotateOnSignal", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	_, err := l.Write([]byte("foo\n"))
+	isNil(err, t)
+	// Signal delivery doesn't synchronize with the handler, so move the
+	// clock before it starts
+	newFakeTime()
+	stop := l.RotateOnSignal(syscall.SIGHUP)
+	proc, err := os.FindProcess(os.Getpid())
+	isNil(err, t)
+	err = proc.Signal(syscall.SIGHUP)
+	isNil(err, t)
+	time.Sleep(sleepTime)
+	existsWithContent(filename, []byte{}, t)
+	exists(backupFile(dir)+compressSuffix, t)
+
+	// Stopping is idempotent, and Close stops any remaining handlers
+	stop()
+	stop()
+	l.RotateOnSignal(syscall.SIGHUP)
+	err = l.Close()
+	isNil(err, t)
+	equals(0, len(l.signalStops), t)
+}
+
+func TestTimestampFormat(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestTimestampFormat", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	// Formats which would be mistaken for a directory or extension are rejected
+	for _, format := range []string{"2006/01/02", `2006\01\02`, "20060102.150405"} {
+		l.TimestampFormat = format
+		notNil(l.Validate(), t)
+	}
+	l.TimestampFormat = "2006-01-02T15-04-05"
+	isNil(l.Validate(), t)
+
+	// Rotations within the same second get a counter
+	newFakeTime()
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		_, err := l.Write([]byte(line))
+		isNil(err, t)
+		err = l.rotate()
+		isNil(err, t)
+	}
+	_, err := l.Write([]byte("four\n"))
+	isNil(err, t)
+	err = l.Close()
+	isNil(err, t)
+
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(3, len(files), t)
+	ts := fakeTime().UTC().Format("2006-01-02T15-04-05")
+	for i, suffix := range []string{".2", ".1", ""} {
+		equals("foobar-"+ts+suffix+".log"+compressSuffix, files[i].Name(), t)
+	}
+
+	muster := NewMuster(filename)
+	muster.TimestampFormat = l.TimestampFormat
+	content, err := ioutil.ReadAll(muster)
+	isNil(err, t)
+	equals("one\ntwo\nthree\nfour\n", string(content), t)
+
+	// With a coarse format, the time isn't moved to the next day either
+	dir2 := makeTempDir("TestTimestampFormatCoarse", t)
+	defer os.RemoveAll(dir2)
+	l2 := NewLogger(
+		/* Filepath:       */ logFile(dir2),
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l2.Close()
+	l2.TimestampFormat = "2006-01-02"
+	l2.Synchronous = true
+	for _, line := range []string{"one\n", "two\n"} {
+		_, err := l2.Write([]byte(line))
+		isNil(err, t)
+		err = l2.rotate()
+		isNil(err, t)
+	}
+	date := fakeTime().UTC().Format("2006-01-02")
+	fakeCurrentTime = fakeCurrentTime.Add(24 * time.Hour)
+	_, err = l2.Write([]byte("three\n"))
+	isNil(err, t)
+	err = l2.rotate()
+	isNil(err, t)
+	err = l2.Close()
+	isNil(err, t)
+
+	files, err = l2.oldLogFiles()
+	isNil(err, t)
+	equals(3, len(files), t)
+	equals("foobar-"+fakeTime().UTC().Format("2006-01-02")+".log"+compressSuffix, files[0].Name(), t)
+	equals("foobar-"+date+".1.log"+compressSuffix, files[1].Name(), t)
+	equals("foobar-"+date+".log"+compressSuffix, files[2].Name(), t)
+}
+
+func TestBackupNameCollision(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestBackupNameCollision", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Synchronous = true
+
+	// Every logfile has the same time, so the archive names collide
+	newFakeTime()
+	l.BackupTimeFn = func(first, last []byte) time.Time {
+		return fakeTime()
+	}
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		_, err := l.Write([]byte(line))
+		isNil(err, t)
+		err = l.rotate()
+		isNil(err, t)
+	}
+
+	backup := backupFile(dir)
+	base := backup[:len(backup)-len(".log")]
+	exists(backup+compressSuffix, t)
+	exists(base+".1.log"+compressSuffix, t)
+	exists(base+".2.log"+compressSuffix, t)
+
+	// The counter keeps them in order
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(3, len(files), t)
+	for i, line := range []string{"three\n", "two\n", "one\n"} {
+		r, err := l.openBackup(filepath.Join(dir, files[i].Name()))
+		isNil(err, t)
+		b, err := ioutil.ReadAll(r)
+		isNil(err, t)
+		r.Close()
+		equals(line, string(b), t)
+	}
+
+	// Muster reads them in order too
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	equals("one\ntwo\nthree\n", string(content), t)
+}
+
+func TestOneFilePerWrite(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestOneFilePerWrite", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ func(msg []byte, buf []byte) ([]byte, int) {
+			buf = append(buf, "> "...)
+			return append(buf, msg...), 2
+		},
+	)
+	defer l.Close()
+	l.OneFilePerWrite = true
+	l.Synchronous = true
+	l.MaxBackups = 3
+
+	// All of the writes are within the same second
+	newFakeTime()
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		n, err := l.Write([]byte(line))
+		isNil(err, t)
+		equals(len(line), n, t)
+	}
+	existsWithContent(filename, []byte{}, t)
+
+	// Each write is its own archive, and the oldest ones were removed
+	backup := backupFile(dir)
+	base := backup[:len(backup)-len(".log")]
+	notExist(backup+compressSuffix, t)
+	notExist(base+".1.log"+compressSuffix, t)
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(3, len(files), t)
+	for i, line := range []string{"five\n", "four\n", "three\n"} {
+		equals(filepath.Base(base)+fmt.Sprintf(".%d.log", 4-i)+compressSuffix, files[i].Name(), t)
+		r, err := l.openBackup(filepath.Join(dir, files[i].Name()))
+		isNil(err, t)
+		b, err := ioutil.ReadAll(r)
+		isNil(err, t)
+		r.Close()
+		equals("> "+line, string(b), t)
+	}
+}
+
+func TestMaxBackupsWithTotalSize(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestMaxBackupsWithTotalSize", t)
+	defer os.RemoveAll(dir)
+
+	// 5 backups of 10 bytes each
+	backups := []string{}
+	for i := 0; i < 5; i++ {
+		newFakeTime()
+		backup := backupFile(dir) + compressSuffix
+		err := ioutil.WriteFile(backup, []byte("0123456789"), defaultFileMode)
+		isNil(err, t)
+		backups = append(backups, backup)
+	}
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 10,
+		/* MaxTotalSizeMB: */ 50,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Synchronous = true
+	l.MaxBackups = 2
+	var errs []error
+	l.OnError = func(err error) { errs = append(errs, err) }
+
+	// The size budget leaves room for 4 backups, and the count for 2. The
+	// oldest ones exceed both, but are only removed once.
+	_, err := l.Write([]byte("foo\n"))
+	isNil(err, t)
+	equals(0, len(errs), t)
+	fileCount(dir, 3, t)
+	for _, backup := range backups[:3] {
+		notExist(backup, t)
+	}
+	for _, backup := range backups[3:] {
+		exists(backup, t)
+	}
+}
+
+func TestLocalTime(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	local := time.Local
+	time.Local = newYork
+	defer func() { time.Local = local }()
+
+	dir := makeTempDir("TestLocalTime", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.TimestampFormat = "2006-01-02T15-04-05"
+	l.LocalTime = true
+
+	// The clock is turned back from 02:00 EDT to 01:00 EST in between
+	for i, utc := range []string{"05:30", "06:10", "07:00"} {
+		fakeCurrentTime, err = time.Parse("2006-01-02 15:04", "2021-11-07 "+utc)
+		isNil(err, t)
+		_, err = l.Write([]byte(fmt.Sprintf("%d\n", i)))
+		isNil(err, t)
+		err = l.rotate()
+		isNil(err, t)
+	}
+	err = l.Close()
+	isNil(err, t)
+
+	// The archive names are local, and never go backwards
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(3, len(files), t)
+	equals("foobar-2021-11-07T02-00-00.log"+compressSuffix, files[0].Name(), t)
+	equals("foobar-2021-11-07T01-30-00.1.log"+compressSuffix, files[1].Name(), t)
+	equals("foobar-2021-11-07T01-30-00.log"+compressSuffix, files[2].Name(), t)
+
+	muster := NewMuster(filename)
+	muster.TimestampFormat = l.TimestampFormat
+	muster.LocalTime = true
+	content, err := ioutil.ReadAll(muster)
+	isNil(err, t)
+	equals("0\n1\n2\n", string(content), t)
+}
+
+func TestLocalTimeFixedZone(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	zone := time.FixedZone("UTC-3", -3*60*60)
+	local := time.Local
+	time.Local = zone
+	defer func() { time.Local = local }()
+
+	// 01:30 UTC is still the previous day in the local zone
+	now, err := time.Parse("2006-01-02 15:04", "2021-03-10 01:30")
+	isNil(err, t)
+
+	for _, tt := range []struct {
+		resolution TimestampResolution
+		format     string
+		name       string
+		ts         time.Time
+	}{
+		{ResolutionSecond, "2006-01-02T15-04-05", "2021-03-09T22-30-00", now},
+		{ResolutionDay, "", "2021-03-09", time.Date(2021, 3, 9, 0, 0, 0, 0, zone)},
+	} {
+		fakeCurrentTime = now
+		dir := makeTempDir("TestLocalTimeFixedZone", t)
+		defer os.RemoveAll(dir)
+
+		filename := logFile(dir)
+		l := NewLogger(
+			/* Filepath:       */ filename,
+			/* MaxLogSizeMB:   */ 100,
+			/* MaxTotalSizeMB: */ 0,
+			/* FormatFn:       */ nil,
+		)
+		l.TimestampResolution = tt.resolution
+		l.TimestampFormat = tt.format
+		l.LocalTime = true
+		l.Synchronous = true
+
+		_, err := l.Write([]byte("one\n"))
+		isNil(err, t)
+		err = l.rotate()
+		isNil(err, t)
+		_, err = l.Write([]byte("two\n"))
+		isNil(err, t)
+		err = l.Close()
+		isNil(err, t)
+
+		// The name is in local time, and parses back to the same instant
+		exists(filepath.Join(dir, "foobar-"+tt.name+".log"+compressSuffix), t)
+		files, err := l.oldLogFiles()
+		isNil(err, t)
+		equals(1, len(files), t)
+		assert(files[0].timestamp.Equal(tt.ts), t, "expected %v, got %v", tt.ts, files[0].timestamp)
+
+		muster := NewMuster(filename)
+		muster.TimestampResolution = tt.resolution
+		muster.TimestampFormat = tt.format
+		muster.LocalTime = true
+		content, err := ioutil.ReadAll(muster)
+		isNil(err, t)
+		equals("one\ntwo\n", string(content), t)
+	}
+}
+
+func TestMixedZoneNames(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	defer func() { time.Local = local }()
+
+	dir := makeTempDir("TestMixedZoneNames", t)
+	defer os.RemoveAll(dir)
+
+	// Each run flips LocalTime, a day after the previous one. The default
+	// names are Unix time, so they mean the same instant either way.
+	filename := logFile(dir)
+	newLogger := func(isLocal bool) *Logger {
+		l := NewLogger(
+			/* Filepath:       */ filename,
+			/* MaxLogSizeMB:   */ 100,
+			/* MaxTotalSizeMB: */ 0,
+			/* FormatFn:       */ nil,
+		)
+		l.LocalTime = isLocal
+		l.Synchronous = true
+		return l
+	}
+	times := []time.Time{}
+	for i, isLocal := range []bool{false, true, false, true} {
+		l := newLogger(isLocal)
+		_, err := l.Write([]byte(fmt.Sprintf("%d\n", i)))
+		isNil(err, t)
+		fakeCurrentTime = fakeCurrentTime.Add(24 * time.Hour)
+		times = append(times, fakeTime().Truncate(time.Second))
+		err = l.rotate()
+		isNil(err, t)
+		err = l.Close()
+		isNil(err, t)
+	}
+
+	// They're in order, whichever convention they were written with
+	for _, isLocal := range []bool{false, true} {
+		l := newLogger(isLocal)
+		files, err := l.oldLogFiles()
+		isNil(err, t)
+		equals(4, len(files), t)
+		for i, f := range files {
+			assert(f.timestamp.Equal(times[3-i]), t, "expected %v, got %v", times[3-i], f.timestamp)
+		}
+	}
+
+	// MaxAge removes the same (oldest) archive either way
+	fakeCurrentTime = fakeCurrentTime.Add(time.Hour)
+	l := newLogger(true)
+	defer l.Close()
+	l.MaxAge = 3
+	_, err := l.Write([]byte("4\n"))
+	isNil(err, t)
+	notExist(filepath.Join(dir, fmt.Sprintf("foobar-%d.log", times[0].Unix()))+compressSuffix, t)
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(3, len(files), t)
+
+	// Muster reads them in order
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	equals("1\n2\n3\n4\n", string(content), t)
+}
+
+func TestFlushInterval(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestFlushInterval", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.FlushInterval = sleepTime / 2
+
+	// Writes are buffered until the next flush
+	_, err := l.Write([]byte("foo\n"))
+	isNil(err, t)
+	existsWithContent(filename, []byte{}, t)
+	time.Sleep(sleepTime)
+	existsWithContent(filename, []byte("foo\n"), t)
+
+	// Rotation and Close flush the rest
+	_, err = l.Write([]byte("bar\n"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	_, err = l.Write([]byte("baz\n"))
+	isNil(err, t)
+	err = l.Close()
+	isNil(err, t)
+	existsWithContent(filename, []byte("baz\n"), t)
+	content, err := ioutil.ReadAll(NewMuster(filename))
+	isNil(err, t)
+	equals("foo\nbar\nbaz\n", string(content), t)
+}
+
+func TestOnRotate(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestOnRotate", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	rotated := make(chan [2]string, 10)
+	l.OnRotate = func(oldPath, newBackupPath string) {
+		rotated <- [2]string{oldPath, newBackupPath}
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := l.Write([]byte("foo\n"))
+		isNil(err, t)
+		newFakeTime()
+		err = l.rotate()
+		isNil(err, t)
+		select {
+		case paths := <-rotated:
+			equals([2]string{filename, backupFile(dir)}, paths, t)
+		case <-time.After(sleepTime):
+			t.Fatal("OnRotate wasn't called")
+		}
+	}
+
+	// An empty logfile isn't rotated, so there's no call
+	err := l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+	equals(0, len(rotated), t)
+}
+
+func TestOnCompress(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestOnCompress", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Synchronous = true
+	l.OnError = func(err error) {}
+	var paths []string
+	var errs []error
+	l.OnCompress = func(backupPath string, err error) {
+		paths = append(paths, backupPath)
+		errs = append(errs, err)
+	}
+
+	_, err := l.Write([]byte("foo\n"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	equals([]string{backupFile(dir) + compressSuffix}, paths, t)
+	isNil(errs[0], t)
+
+	// A failure surfaces to the hook, and the archive is left uncompressed
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		return errors.New("disk full")
+	}
+	_, err = l.Write([]byte("bar\n"))
+	isNil(err, t)
+	fakeCurrentTime = fakeCurrentTime.Add(time.Second)
+	err = l.rotate()
+	isNil(err, t)
+	equals(2, len(paths), t)
+	equals(backupFile(dir)+compressSuffix, paths[1], t)
+	notNil(errs[1], t)
+	assert(strings.Contains(errs[1].Error(), "disk full"), t, "unexpected error: %v", errs[1])
+	existsWithContent(backupFile(dir), []byte("bar\n"), t)
+}
+
+func TestErrors(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestErrors", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.OnError = func(err error) {}
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		return errors.New("disk full")
+	}
+	errs := l.Errors()
+
+	// Mill errors surface on the channel
+	_, err := l.Write([]byte("foo\n"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	select {
+	case err := <-errs:
+		assert(strings.Contains(err.Error(), "disk full"), t, "unexpected error: %v", err)
+	case <-time.After(sleepTime):
+		t.Fatal("no error on the channel")
+	}
+
+	// Errors are dropped rather than blocking while the channel is full
+	for i := 0; i < 2*errorsQueueSize; i++ {
+		l.reportError("test", errors.New("dropped"))
+	}
+	equals(errorsQueueSize, len(errs), t)
+
+	// The channel is closed once the mill is stopped
+	err = l.Close()
+	isNil(err, t)
+	n := 0
+	for range errs {
+		n++
+	}
+	equals(errorsQueueSize, n, t)
+}
+
+func TestSymlink(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestSymlink", t)
+	defer os.RemoveAll(dir)
+	linkDir := makeTempDir("TestSymlinkLink", t)
+	defer os.RemoveAll(linkDir)
+
+	filename := logFile(dir)
+	link := filepath.Join(linkDir, "current.log")
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Symlink = link
+
+	b := []byte("boo!")
+	n, err := l.Write(b)
+	isNil(err, t)
+	equals(len(b), n, t)
+	existsWithContent(link, b, t)
+
+	// The symlink still points at the logfile after rotation
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	b2 := []byte("foooooo!")
+	_, err = l.Write(b2)
+	isNil(err, t)
+	existsWithContent(link, b2, t)
+	notExist(link+".tmp", t)
+
+	// A regular file at the symlink path is not replaced
+	l.Close()
+	err = os.Remove(link)
+	isNil(err, t)
+	err = ioutil.WriteFile(link, []byte("mine"), 0644)
+	isNil(err, t)
+	l2 := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l2.Close()
+	l2.Symlink = link
+	_, err = l2.Write(b)
+	notNil(err, t)
+	assert(strings.Contains(err.Error(), "not a symlink"), t, "unexpected error: %v", err)
+	existsWithContent(link, []byte("mine"), t)
+}
+
+func TestFileMode(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestFileMode", t)
+	defer os.RemoveAll(dir)
+
+	logDir := filepath.Join(dir, "logs")
+	filename := filepath.Join(logDir, "foobar.log")
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.FileMode = 0600
+	l.DirMode = 0700
+
+	// The log directory is created as needed
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+	info, err := os.Stat(logDir)
+	isNil(err, t)
+	equals(os.FileMode(0700), info.Mode().Perm(), t)
+	info, err = os.Stat(filename)
+	isNil(err, t)
+	equals(os.FileMode(0600), info.Mode().Perm(), t)
+
+	// Both the new logfile and the compressed archive get FileMode
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	<-time.After(sleepTime)
+	info, err = os.Stat(filename)
+	isNil(err, t)
+	equals(os.FileMode(0600), info.Mode().Perm(), t)
+	info, err = os.Stat(backupFile(logDir) + compressSuffix)
+	isNil(err, t)
+	equals(os.FileMode(0600), info.Mode().Perm(), t)
+}
+
+func TestCopyFileMetadata(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestCopyFileMetadata", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.CopyFileMetadata = true
+
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+	// e.g. changed by an admin
+	err = os.Chmod(filename, 0640)
+	isNil(err, t)
+
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	<-time.After(sleepTime)
+	info, err := os.Stat(backupFile(dir) + compressSuffix)
+	isNil(err, t)
+	equals(os.FileMode(0640), info.Mode().Perm(), t)
+}
+
+func TestShutdown(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestShutdown", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	newLogger := func() *Logger {
+		l := NewLogger(
+			/* Filepath:       */ filename,
+			/* MaxLogSizeMB:   */ 100,
+			/* MaxTotalSizeMB: */ 0,
+			/* FormatFn:       */ nil,
+		)
+		// A slow compressor which takes a second
+		l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+			buf := make([]byte, 1)
+			for {
+				time.Sleep(sleepTime / 10)
+				n, err := src.Read(buf)
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return err
+				}
+			}
+		}
+		return l
+	}
+
+	// The mill finishes in time
+	l := newLogger()
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*sleepTime)
+	defer cancel()
+	err = l.Shutdown(ctx)
+	isNil(err, t)
+	exists(backupFile(dir)+compressSuffix, t)
+	isNil(l.Close(), t)
+
+	// The deadline passes first, but the compression still finishes
+	l = newLogger()
+	_, err = l.Write(bytes.Repeat([]byte("x"), 100))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), sleepTime)
+	defer cancel2()
+	start := time.Now()
+	err = l.Shutdown(ctx2)
+	equals(context.DeadlineExceeded, err, t)
+	assert(time.Since(start) < 5*sleepTime, t, "expected a timely return, took %s", time.Since(start))
+	exists(backupFile(dir), t)
+	l.StopMill()
+	notExist(backupFile(dir), t)
+	exists(backupFile(dir)+compressSuffix, t)
+	isNil(l.Close(), t)
+
+	// Once the mill is stopped, rotating no longer signals it, and the
+	// archive is left for the next Logger
+	l = newLogger()
+	err = l.Shutdown(context.Background())
+	isNil(err, t)
+	_, err = l.Write([]byte("foo!"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.Rotate()
+	isNil(err, t)
+	time.Sleep(sleepTime)
+	existsWithContent(backupFile(dir), []byte("foo!"), t)
+	isNil(l.Close(), t)
+}
+
+func TestRotateOnStart(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestRotateOnStart", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	newLogger := func(rotateOnStart bool) *Logger {
+		l := NewLogger(
+			/* Filepath:       */ filename,
+			/* MaxLogSizeMB:   */ 10,
+			/* MaxTotalSizeMB: */ 0,
+			/* FormatFn:       */ nil,
+		)
+		l.RotateOnStart = rotateOnStart
+		// Keep archives as they are, to check their content
+		l.Compression = None{}
+		return l
+	}
+
+	// A logfile past the size limit is rotated up front
+	large := bytes.Repeat([]byte("x"), 12)
+	err := ioutil.WriteFile(filename, large, defaultFileMode)
+	isNil(err, t)
+	newFakeTime()
+	l := newLogger(false)
+	_, err = l.Write([]byte("boo!"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("boo!"), t)
+	existsWithContent(backupFile(dir), large, t)
+	l.Close()
+	fileCount(dir, 2, t)
+
+	// A small logfile is appended to
+	newFakeTime()
+	l = newLogger(false)
+	_, err = l.Write([]byte("foo"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("boo!foo"), t)
+	l.Close()
+	fileCount(dir, 2, t)
+
+	// ...unless RotateOnStart is set, but only when first opened
+	newFakeTime()
+	l = newLogger(true)
+	defer l.Close()
+	_, err = l.Write([]byte("bar"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("bar"), t)
+	existsWithContent(backupFile(dir), []byte("boo!foo"), t)
+	_, err = l.Write([]byte("baz"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("barbaz"), t)
+	fileCount(dir, 3, t)
+}
+
+func TestHeader(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestHeader", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	newLogger := func() *Logger {
+		l := NewLogger(
+			/* Filepath:       */ filename,
+			/* MaxLogSizeMB:   */ 100,
+			/* MaxTotalSizeMB: */ 0,
+			/* FormatFn:       */ nil,
+		)
+		l.Header = func() []byte { return []byte("# v1\n") }
+		l.Compression = None{}
+		return l
+	}
+
+	// The header starts a new logfile, and counts toward its size
+	l := newLogger()
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+	_, err = l.Write([]byte("foo"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("# v1\nboo!foo"), t)
+	equals(int64(12), l.size, t)
+	l.Close()
+
+	// ...but not one that is appended to
+	l = newLogger()
+	defer l.Close()
+	_, err = l.Write([]byte("bar"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("# v1\nboo!foobar"), t)
+
+	// Each rotation starts a new logfile
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	_, err = l.Write([]byte("baz"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("# v1\nbaz"), t)
+	existsWithContent(backupFile(dir), []byte("# v1\nboo!foobar"), t)
+
+	// A logfile holding only its header isn't worth archiving
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	existsWithContent(filename, []byte("# v1\n"), t)
+	fileCount(dir, 3, t)
+}
+
+func TestStats(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestStats", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Compression = None{}
+
+	equals(Stats{}, l.Stats(), t)
+
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	_, err = l.Write([]byte("foooooo!"))
+	isNil(err, t)
+	newFakeTime()
+	err = l.rotate()
+	isNil(err, t)
+	_, err = l.Write([]byte("bar"))
+	isNil(err, t)
+
+	stats := l.Stats()
+	equals(int64(3), stats.CurrentSize, t)
+	equals(uint64(2), stats.Rotations, t)
+	equals(2, stats.BackupCount, t)
+	equals(int64(12), stats.TotalBackupBytes, t)
+}
+
+func TestMetricsHooks(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestMetricsHooks", t)
+	defer os.RemoveAll(dir)
+
+	prefix := func(msg []byte, buf []byte) ([]byte, int) {
+		buf = append(buf, "pre:"...)
+		return append(buf, msg...), 4
+	}
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 18,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ prefix,
+	)
+	defer l.Close()
+	var bytesWritten, rotations int
+	l.OnBytesWritten = func(n int) { bytesWritten += n }
+	l.OnRotateMetric = func() { rotations++ }
+
+	// 8 bytes each, so every other write rotates
+	for i := 0; i < 5; i++ {
+		_, err := l.Write([]byte("boo!"))
+		isNil(err, t)
+		newFakeTime()
+	}
+	equals(40, bytesWritten, t)
+	equals(2, rotations, t)
+}
+
+func TestReopen(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestReopen", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+
+	// An external tool moves the logfile away
+	moved := filepath.Join(dir, "moved.log")
+	err = os.Rename(filename, moved)
+	isNil(err, t)
+	err = l.Reopen()
+	isNil(err, t)
+	equals(int64(0), l.size, t)
+	_, err = l.Write([]byte("foo"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("foo"), t)
+	existsWithContent(moved, []byte("boo!"), t)
+
+	// ...or replaces it with another file
+	err = ioutil.WriteFile(filename+".new", []byte("other"), defaultFileMode)
+	isNil(err, t)
+	err = os.Rename(filename+".new", filename)
+	isNil(err, t)
+	err = l.Reopen()
+	isNil(err, t)
+	equals(int64(5), l.size, t)
+	_, err = l.Write([]byte("bar"))
+	isNil(err, t)
+	existsWithContent(filename, []byte("otherbar"), t)
+
+	// Nothing is rotated or compressed
+	time.Sleep(sleepTime)
+	fileCount(dir, 2, t)
+}
+
+func TestSubdirLayout(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestSubdirLayout", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.SubdirLayout = "2006/01/02"
+	l.MaxBackups = 2
+
+	subdir := func() string {
+		return filepath.Join(dir, fakeCurrentTime.UTC().Format("2006/01/02"))
+	}
+	var subdirs []string
+	for i := 0; i < 3; i++ {
+		_, err := l.Write([]byte("boo!"))
+		isNil(err, t)
+		newFakeTime()
+		err = l.rotate()
+		isNil(err, t)
+		<-time.After(sleepTime)
+
+		// Archives land in the subdirectory of their day
+		subdirs = append(subdirs, subdir())
+		exists(filepath.Join(subdir(), filepath.Base(backupFile(dir))+compressSuffix), t)
+	}
+
+	// Retention prunes across subdirectories, and removes emptied ones
+	files, err := l.oldLogFiles()
+	isNil(err, t)
+	equals(2, len(files), t)
+	notExist(subdirs[0], t)
+	exists(subdirs[1], t)
+	exists(subdirs[2], t)
+}
+
+func TestCompressLevel(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	content := bytes.Repeat([]byte("boo! foooooo! "), 100)
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		dir := makeTempDir("TestCompressLevel", t)
+		defer os.RemoveAll(dir)
+
+		l := NewLogger(
+			/* Filepath:       */ logFile(dir),
+			/* MaxLogSizeMB:   */ 100000,
+			/* MaxTotalSizeMB: */ 0,
+			/* FormatFn:       */ nil,
+		)
+		l.CompressLevel = level
+		isNil(l.Validate(), t)
+		_, err := l.Write(content)
+		isNil(err, t)
+		newFakeTime()
+		err = l.rotate()
+		isNil(err, t)
+		<-time.After(sleepTime)
+		l.Close()
+
+		f, err := os.Open(backupFile(dir) + compressSuffix)
+		isNil(err, t)
+		gz, err := gzip.NewReader(f)
+		isNil(err, t)
+		b, err := ioutil.ReadAll(gz)
+		isNil(err, t)
+		f.Close()
+		equals(string(content), string(b), t)
+	}
+
+	// Levels gzip doesn't support are rejected
+	l := &Logger{CompressLevel: 42}
+	notNil(l.Validate(), t)
+	l.CompressLevel = gzip.DefaultCompression
+	isNil(l.Validate(), t)
+}
+
+func TestRetentionMixedCompression(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestRetentionMixedCompression", t)
+	defer os.RemoveAll(dir)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Synchronous = true
+	l.MaxBackups = 3
+
+	// Two gzipped archives, then plaintext ones after disabling compression
+	var backups []string
+	rotate := func() {
+		_, err := l.Write([]byte("boo!"))
+		isNil(err, t)
+		newFakeTime()
+		err = l.rotate()
+		isNil(err, t)
+		backups = append(backups, backupFile(dir)+l.archiveSuffix())
+	}
+	rotate()
+	rotate()
+	l.Compression = None{}
+	rotate()
+	fileCount(dir, 4, t)
+
+	// Retention counts both kinds
+	rotate()
+	notExist(backups[0], t)
+	exists(backups[1], t)
+	existsWithContent(backups[2], []byte("boo!"), t)
+	existsWithContent(backups[3], []byte("boo!"), t)
+	fileCount(dir, 4, t)
+}
+
+func TestHooksWithoutCompression(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestHooksWithoutCompression", t)
+	defer os.RemoveAll(dir)
+	mirror := filepath.Join(dir, "mirror")
+	err := os.Mkdir(mirror, 0700)
+	isNil(err, t)
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.Compression = None{}
+	l.Synchronous = true
+	l.Mirror = []string{mirror}
+	var compressed, rotated []string
+	var errs []error
+	l.OnCompress = func(backupPath string, err error) {
+		compressed = append(compressed, backupPath)
+		errs = append(errs, err)
+	}
+	l.PostRotate = func(backupPath string) error {
+		rotated = append(rotated, backupPath)
+		return nil
+	}
+
+	// Each archive is final once it's rotated, so the hooks run for it then
+	expected := []string{}
+	for _, s := range []string{"foo\n", "bar\n"} {
+		_, err := l.Write([]byte(s))
+		isNil(err, t)
+		newFakeTime()
+		expected = append(expected, backupFile(dir))
+		err = l.rotate()
+		isNil(err, t)
+		equals(expected, compressed, t)
+		equals(expected, rotated, t)
+		isNil(errs[len(errs)-1], t)
+		existsWithContent(filepath.Join(mirror, filepath.Base(backupFile(dir))), []byte(s), t)
+	}
+
+	// The hooks run once per archive
+	l.mill()
+	equals(expected, compressed, t)
+	equals(expected, rotated, t)
+}
+
+func TestCompressWorkers(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestCompressWorkers", t)
+	defer os.RemoveAll(dir)
+
+	// A backlog of uncompressed archives
+	var backups []string
+	for i := 0; i < 6; i++ {
+		newFakeTime()
+		err := ioutil.WriteFile(backupFile(dir), []byte("boo!"), defaultFileMode)
+		isNil(err, t)
+		backups = append(backups, backupFile(dir))
+	}
+
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	l.CompressWorkers = 3
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	l.TransformBackup = func(src io.Reader, dst io.Writer) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(sleepTime / 2)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	_, err := l.Write([]byte("foo"))
+	isNil(err, t)
+	l.StopMill()
+
+	for _, backup := range backups {
+		notExist(backup, t)
+		exists(backup+compressSuffix, t)
+	}
+	equals(3, maxRunning, t)
+	equals(0, l.Stats().MillBacklog, t)
+}
+
+func TestCurrentFilename(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestCurrentFilename", t)
+	defer os.RemoveAll(dir)
+
+	// The path is cleaned and made absolute
+	wd, err := os.Getwd()
+	isNil(err, t)
+	rel, err := filepath.Rel(wd, dir)
+	isNil(err, t)
+	l := NewLogger(
+		/* Filepath:       */ filepath.Join(rel, "sub", "..", "foobar.log"),
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+
+	equals("", l.CurrentFilename(), t)
+	_, err = l.Write([]byte("boo!"))
+	isNil(err, t)
+	equals(logFile(dir), l.CurrentFilename(), t)
+
+	newFakeTime()
+	err = l.Rotate()
+	isNil(err, t)
+	equals(logFile(dir), l.CurrentFilename(), t)
+	err = l.Reopen()
+	isNil(err, t)
+	equals(logFile(dir), l.CurrentFilename(), t)
+}
+
+func TestWriteString(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestWriteString", t)
+	defer os.RemoveAll(dir)
+
+	prefix := func(msg []byte, buf []byte) ([]byte, int) {
+		buf = append(buf, "pre:"...)
+		return append(buf, msg...), 4
+	}
+	filename := logFile(dir)
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ prefix,
+	)
+	defer l.Close()
+
+	var _ io.StringWriter = l
+	n, err := l.WriteString("boo!")
+	isNil(err, t)
+	equals(4, n, t)
+	n, err = io.WriteString(l, "foo")
+	isNil(err, t)
+	equals(3, n, t)
+	existsWithContent(filename, []byte("pre:boo!pre:foo"), t)
+	equals(int64(15), l.size, t)
+}
+
+func BenchmarkWriteString(b *testing.B) {
+	dir, err := ioutil.TempDir("", "BenchmarkWriteString")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	msg := "2017-07-14 02:40:00.000 : some message of a typical length\n"
+	for _, isString := range []bool{false, true} {
+		b.Run(fmt.Sprintf("WriteString=%v", isString), func(b *testing.B) {
+			l := NewLogger(
+				/* Filepath:       */ filepath.Join(dir, "foobar.log"),
+				/* MaxLogSizeMB:   */ 1 << 30,
+				/* MaxTotalSizeMB: */ 0,
+				/* FormatFn:       */ nil,
+			)
+			defer l.Close()
+			if _, err := l.Write(nil); err != nil {
+				b.Fatal(err)
+			}
+			// Only the Logger is measured, not the disk
+			l.file = nopWriteCloser{ioutil.Discard}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if isString {
+					_, err = l.WriteString(msg)
+				} else {
+					_, err = l.Write([]byte(msg))
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkWriteLock measures what the write lock costs an uncontended
+// Write, by contrast with writing without it.
+func BenchmarkWriteLock(b *testing.B) {
+	dir, err := ioutil.TempDir("", "BenchmarkWriteLock")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	msg := []byte("2017-07-14 02:40:00.000 : some message of a typical length\n")
+	for _, isLocked := range []bool{true, false} {
+		b.Run(fmt.Sprintf("Locked=%v", isLocked), func(b *testing.B) {
+			l := NewLogger(
+				/* Filepath:       */ filepath.Join(dir, "foobar.log"),
+				/* MaxLogSizeMB:   */ 1 << 30,
+				/* MaxTotalSizeMB: */ 0,
+				/* FormatFn:       */ nil,
+			)
+			defer l.Close()
+			if _, err := l.Write(nil); err != nil {
+				b.Fatal(err)
+			}
+			// Only the Logger is measured, not the disk
+			l.file = nopWriteCloser{ioutil.Discard}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if isLocked {
+					_, err = l.Write(msg)
+				} else {
+					_, err = l.writeMsg(msg)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxFmtBufCap(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestMaxFmtBufCap", t)
+	defer os.RemoveAll(dir)
+
+	prefix := func(msg []byte, buf []byte) ([]byte, int) {
+		buf = append(buf, "pre:"...)
+		return append(buf, msg...), 4
+	}
+	l := NewLogger(
+		/* Filepath:       */ logFile(dir),
+		/* MaxLogSizeMB:   */ 1 << 20,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ prefix,
+	)
+	defer l.Close()
+	l.MaxFmtBufCap = 1024
+
+	_, err := l.Write([]byte("boo!"))
+	isNil(err, t)
+	assert(cap(l.fmtbuf) > 0, t, "expected the buffer to be kept")
+
+	// A huge message doesn't keep its buffer
+	_, err = l.Write(bytes.Repeat([]byte("x"), 64*1024))
+	isNil(err, t)
+	_, err = l.Write([]byte("foo"))
+	isNil(err, t)
+	assert(cap(l.fmtbuf) <= 1024, t, "expected the buffer to shrink, got capacity %d", cap(l.fmtbuf))
+
+	// ...unless MaxFmtBufCap is unset
+	l.MaxFmtBufCap = 0
+	_, err = l.Write(bytes.Repeat([]byte("x"), 64*1024))
+	isNil(err, t)
+	_, err = l.Write([]byte("foo"))
+	isNil(err, t)
+	assert(cap(l.fmtbuf) > 64*1024, t, "expected the buffer to be kept, got capacity %d", cap(l.fmtbuf))
+}
+
+func TestMissingLogDir(t *testing.T) {
+	nowFn = fakeTime
+	MB = 1
+
+	dir := makeTempDir("TestMissingLogDir", t)
+	defer os.RemoveAll(dir)
+
+	logDir := filepath.Join(dir, "var", "log", "myapp")
+	filename := filepath.Join(logDir, "foobar.log")
+	l := NewLogger(
+		/* Filepath:       */ filename,
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l.Close()
+	var errs []error
+	l.OnError = func(err error) { errs = append(errs, err) }
+	l.RepairOnStart = true
+
+	// The first write creates the tree
+	b := []byte("boo!")
+	_, err := l.Write(b)
+	isNil(err, t)
+	existsWithContent(filename, b, t)
+	time.Sleep(sleepTime)
+	equals(0, len(errs), t)
+
+	// A directory that can't be created is reported
+	blocker := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(blocker, nil, defaultFileMode)
+	isNil(err, t)
+	l2 := NewLogger(
+		/* Filepath:       */ filepath.Join(blocker, "myapp", "foobar.log"),
+		/* MaxLogSizeMB:   */ 100,
+		/* MaxTotalSizeMB: */ 0,
+		/* FormatFn:       */ nil,
+	)
+	defer l2.Close()
+	l2.Diagnostics = ioutil.Discard
+	_, err = l2.Write(b)
+	notNil(err, t)
+	assert(strings.Contains(err.Error(), "can't make log directory"), t, "unexpected error: %v", err)
+}
@@ -1,59 +1,312 @@
 package tumble
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 const (
-	compressSuffix = ".gz"
-	fileMode       = 0644
+	compressSuffix      = ".gz"
+	compressTmpSuffix   = ".tmp"
+	defaultFileMode     = 0644
+	defaultDirMode      = 0755
+	defaultMaxLogSizeMB = 100
+
+	defaultCompressBufferSize = 32 * 1024
+	defaultCompressBackoff    = time.Second
+
+	rateWindow = time.Second
 )
 
-// Ensure we always implement io.WriteCloser
+// Ensure we always implement io.WriteCloser and io.WriterTo
 var _ io.WriteCloser = (*Logger)(nil)
+var _ io.WriterTo = (*Logger)(nil)
 
 var (
 	// These constants are mocked out by tests
-	nowFn = time.Now
-	MB    = uint(1024 * 1024)
+	nowFn            = time.Now
+	MB               = uint(1024 * 1024)
+	setLowPriorityFn = setLowPriority
+	openFileFn       = os.OpenFile
+	preallocateFn    = preallocate
+	millDeferRetry   = time.Second
+	renameFn         = os.Rename
+	freeInodesFn     = freeInodes
+	freeBytesFn      = freeBytes
 )
 
 func NewLogger(fpath string, maxLogSizeMB, maxTotalSizeMB uint, formatFn func(msg []byte, buf []byte) ([]byte, int)) *Logger {
 	logger := &Logger{
 		/* Filepath:       */ filepath.Clean(fpath),
+		/* Filename:       */ "",
 		/* MaxLogSizeMB:   */ maxLogSizeMB,
 		/* MaxTotalSizeMB: */ maxTotalSizeMB,
 		/* FormatFn:       */ formatFn,
+		/* MaxSize:        */ 0,
+		/* MaxBackups:     */ 0,
+		/* MaxAge:         */ 0,
+
+		/* OnError:         */ nil,
+		/* TransformBackup: */ nil,
+		/* LowPriorityMill: */ false,
+		/* PreviousName:    */ "",
+		/* KeepNewestBackup: */ false,
+		/* RetentionScanInterval: */ 0,
+		/* RotationSummary:       */ false,
+		/* GzipComment:           */ "",
+		/* RepairOnStart:         */ false,
+		/* RotateEmptyFiles:      */ false,
+		/* RotateOnStart:         */ false,
+		/* ShouldRotate:          */ nil,
+		/* AsyncQueue:            */ 0,
+		/* AsyncDrop:             */ false,
+		/* OpenFlags:             */ 0,
+		/* CompressBufferSize:    */ 0,
+		/* PreallocateActive:     */ false,
+		/* MillDeferRate:         */ 0,
+		/* Diagnostics:           */ nil,
+		/* PostRotate:            */ nil,
+		/* ExecPostRotate:        */ nil,
+		/* Encrypter:             */ nil,
+		/* Metrics:               */ nil,
+		/* CoalesceBackups:       */ false,
+		/* CoalesceSizeMB:        */ 0,
+		/* Synchronous:           */ false,
+		/* SequenceNumbers:       */ false,
+		/* SequenceSidecar:       */ false,
+		/* MinFreeInodes:         */ 0,
+		/* BackupTimeFn:          */ nil,
+		/* CompressDelay:         */ 0,
+		/* ClockSkew:             */ SkewBumpName,
+		/* Mirror:                */ nil,
+		/* MirrorLockstep:        */ false,
+		/* MaxActiveAge:          */ 0,
+		/* TimestampResolution:   */ ResolutionSecond,
+		/* TriggerPolicy:         */ nil,
+		/* OnRotatePaths:         */ nil,
+		/* CompressRetries:       */ 0,
+		/* CompressBackoff:       */ 0,
+		/* MaxLogAge:             */ 0,
+		/* BucketBy:              */ BucketNone,
+		/* PerBucketKeep:         */ 0,
+		/* WarmStandby:           */ false,
+		/* Compression:           */ nil,
+		/* TimestampFormat:       */ "",
+		/* LocalTime:             */ false,
+		/* FlushInterval:         */ 0,
+		/* OnRotate:              */ nil,
+		/* OnCompress:            */ nil,
+		/* Symlink:               */ "",
+		/* FileMode:              */ 0,
+		/* DirMode:               */ 0,
+		/* CopyFileMetadata:      */ false,
+		/* Header:                */ nil,
+		/* OnBytesWritten:        */ nil,
+		/* OnRotateMetric:        */ nil,
+		/* SubdirLayout:          */ "",
+		/* CompressLevel:         */ 0,
+		/* CompressWorkers:       */ 0,
+		/* MinFreeBytes:          */ 0,
+		/* MaxFmtBufCap:          */ 0,
+		/* OneFilePerWrite:       */ false,
 
+		/* mu:             */ sync.Mutex{},
 		/* file:           */ nil,
 		/* size:           */ 0,
 		/* millCh:         */ make(chan struct{}, 2),
+		/* millMu:         */ sync.Mutex{},
 		/* millWG:         */ sync.WaitGroup{},
+		/* startMillOnce:  */ sync.Once{},
 		/* stopMillOnce:   */ sync.Once{},
+		/* millChMu:       */ sync.Mutex{},
+		/* isMillStopped:  */ false,
 		/* fmtbuf:         */ nil,
-	}
 
-	logger.millWG.Add(1)
-	go logger.millRun()
+		/* openedAt:       */ time.Time{},
+		/* fileStart:      */ time.Time{},
+		/* isBudgetWarned: */ false,
+		/* isRepaired:     */ false,
+
+		/* asyncCh:        */ nil,
+		/* asyncMu:        */ sync.RWMutex{},
+		/* asyncOnce:      */ sync.Once{},
+		/* asyncWG:        */ sync.WaitGroup{},
+		/* isAsyncStopped: */ false,
+		/* droppedMu:      */ sync.Mutex{},
+		/* dropped:        */ 0,
+
+		/* rateMu:         */ sync.Mutex{},
+		/* rateStart:      */ time.Time{},
+		/* rateBytes:      */ 0,
+		/* rate:           */ 0,
+		/* isMillDeferred: */ false,
+
+		/* statsMu:        */ sync.Mutex{},
+		/* millBacklog:    */ 0,
+
+		/* isMillStopping:  */ false,
+		/* abandonMu:       */ sync.Mutex{},
+		/* isMillAbandoned: */ false,
+
+		/* seq:             */ 0,
+		/* seqbuf:          */ nil,
+		/* isSeqLoaded:     */ false,
+
+		/* compressDue:     */ time.Time{},
+		/* lastBackupTime:  */ time.Time{},
+
+		/* standbyMu:        */ sync.Mutex{},
+		/* standbyWG:        */ sync.WaitGroup{},
+		/* standby:          */ nil,
+		/* isStandbyPending: */ false,
+
+		/* signalMu:    */ sync.Mutex{},
+		/* signalStops: */ nil,
+
+		/* flushOnce: */ sync.Once{},
+		/* flushStop: */ nil,
+
+		/* errorsMu:       */ sync.Mutex{},
+		/* errorsCh:       */ nil,
+		/* isErrorsClosed: */ false,
+
+		/* isRotatedOnStart: */ false,
+		/* headerSize:       */ 0,
+		/* rotations:        */ 0,
+		/* strbuf:           */ nil,
+
+		/* finalizedMu: */ sync.Mutex{},
+		/* finalized:   */ nil,
+	}
 
 	return logger
 }
 
+// Validate checks the Logger's configuration. It is called whenever the
+// logfile is opened, but may be called beforehand to catch errors early.
+func (me *Logger) Validate() error {
+	// The access mode is always O_WRONLY, and the logfile is only truncated
+	// when we create it ourselves.
+	invalidFlags := os.O_WRONLY | os.O_RDWR | os.O_TRUNC | os.O_EXCL
+	if me.OpenFlags&invalidFlags != 0 {
+		return fmt.Errorf("invalid OpenFlags %#x: access mode, O_TRUNC and O_EXCL are not allowed", me.OpenFlags)
+	}
+	if directFlag != 0 && me.OpenFlags&directFlag != 0 {
+		return fmt.Errorf("invalid OpenFlags %#x: O_DIRECT requires aligned writes", me.OpenFlags)
+	}
+	if err := validateLevel(me.CompressLevel); err != nil {
+		return err
+	}
+	return me.layout().validate()
+}
+
+// fpath is the path of the logfile, honoring the legacy Filename alias.
+func (me *Logger) fpath() string {
+	if me.Filename != "" {
+		return filepath.Clean(me.Filename)
+	}
+	return me.Filepath
+}
+
+// maxLogSize is the logfile size (in bytes) before it gets rotated,
+// honoring the Lumberjack-named MaxSize option.
+func (me *Logger) maxLogSize() int64 {
+	sizeMB := me.MaxLogSizeMB
+	if me.MaxSize > 0 {
+		sizeMB = uint(me.MaxSize)
+	}
+	if sizeMB == 0 {
+		sizeMB = defaultMaxLogSizeMB
+	}
+	return int64(sizeMB * MB)
+}
+
+// fileMode is the permissions of new logfiles and archives.
+func (me *Logger) fileMode() os.FileMode {
+	if me.FileMode == 0 {
+		return defaultFileMode
+	}
+	return me.FileMode
+}
+
+// dirMode is the permissions of a new log directory.
+func (me *Logger) dirMode() os.FileMode {
+	if me.DirMode == 0 {
+		return defaultDirMode
+	}
+	return me.DirMode
+}
+
+// ErrDiskFull is returned by Write when less than MinFreeBytes would be left
+// free on the filesystem of the logfile, even after removing all archives.
+// Nothing is written in that case.
+var ErrDiskFull = errors.New("not enough free disk space")
+
 func (me *Logger) Write(p []byte) (n int, err error) {
+	if me.AsyncQueue > 0 && me.writeAsync(p) {
+		return len(p), nil
+	}
+	return me.write(p)
+}
+
+// WriteString is like Write, but saves converting s to a []byte (unless
+// AsyncQueue is set, since the message is queued).
+func (me *Logger) WriteString(s string) (n int, err error) {
+	if me.AsyncQueue > 0 {
+		return me.Write([]byte(s))
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	me.strbuf = append(me.strbuf[:0], s...)
+	return me.writeMsg(me.strbuf)
+}
+
+func (me *Logger) write(p []byte) (n int, err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	return me.writeMsg(p)
+}
+
+// writeMsg writes p to the logfile, rotating it first if needed. me.mu
+// must be held.
+func (me *Logger) writeMsg(p []byte) (n int, err error) {
 	writeLen := int64(len(p))
 
+	// As mu is held, concurrent first writes find the logfile opened by
+	// whichever of them came first
 	if me.file == nil {
 		if err = me.openExistingOrNew(len(p)); err != nil {
+			me.diagnose("Write", err)
 			return 0, err
 		}
-	} else if me.size+writeLen > int64(me.MaxLogSizeMB*MB) {
+	} else if me.isRotationDue(writeLen) {
 		if err := me.rotate(); err != nil {
+			me.diagnose("Write", err)
 			return 0, err
 		}
 	}
+	if me.MinFreeBytes > 0 {
+		if err := me.ensureFreeBytes(writeLen); err != nil {
+			me.diagnose("Write", err)
+			return 0, err
+		}
+	}
+
+	if me.fileStart.IsZero() {
+		me.fileStart = nowFn()
+	}
 
 	var msg []byte
 	var msgIdx int
@@ -64,22 +317,314 @@ func (me *Logger) Write(p []byte) (n int, err error) {
 	} else {
 		msg = p
 	}
+	if me.SequenceNumbers {
+		me.seq++
+		me.seqbuf = strconv.AppendUint(me.seqbuf[:0], me.seq, 10)
+		me.seqbuf = append(me.seqbuf, ' ')
+		msgIdx += len(me.seqbuf)
+		me.seqbuf = append(me.seqbuf, msg...)
+		msg = me.seqbuf
+	}
 
-	n, err = me.file.Write(msg)
+	n, err = me.writeFull(msg)
+	if errors.Is(err, syscall.EBADF) || errors.Is(err, syscall.EIO) {
+		n, err = me.recoverBadFile(msg, n, err)
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		n, err = me.recoverNoSpace(msg, n, err)
+	}
 	me.size += int64(n)
-	if me.FormatFn != nil {
-		// Return length of p consumed
-		if n < msgIdx {
-			return 0, err
+	if me.MaxFmtBufCap > 0 {
+		me.shrinkBuffers()
+	}
+	if me.MillDeferRate > 0 {
+		me.addWriteRate(n)
+	}
+	if me.OnBytesWritten != nil && n > 0 {
+		me.OnBytesWritten(n)
+	}
+	if me.OneFilePerWrite && err == nil {
+		// The record is written, so a failure to rotate doesn't fail the
+		// write. The record then goes with the next one.
+		if rotateErr := me.rotate(); rotateErr != nil {
+			me.reportError("Write", rotateErr)
+		}
+	}
+	if me.FormatFn != nil || me.SequenceNumbers {
+		return consumed(n, msgIdx, len(p), err), err
+	}
+	return n, err
+}
+
+// shrinkBuffers drops the buffers reused for formatting once they've grown
+// past MaxFmtBufCap, so that a huge message doesn't hold on to memory.
+func (me *Logger) shrinkBuffers() {
+	if cap(me.fmtbuf) > me.MaxFmtBufCap {
+		me.fmtbuf = nil
+	}
+	if cap(me.seqbuf) > me.MaxFmtBufCap {
+		me.seqbuf = nil
+	}
+	if cap(me.strbuf) > me.MaxFmtBufCap {
+		me.strbuf = nil
+	}
+}
+
+// writeFull writes all of msg to the file. A short write without an error
+// (which breaks the io.Writer contract) is retried with the rest of msg,
+// as long as there's progress, so that no formatted bytes are dropped.
+func (me *Logger) writeFull(msg []byte) (int, error) {
+	n := 0
+	for n < len(msg) {
+		m, err := me.file.Write(msg[n:])
+		n += m
+		if err != nil {
+			return n, err
 		}
-		if n-msgIdx > len(p) {
-			return len(p), err
+		if m == 0 {
+			return n, io.ErrShortWrite
 		}
-		return n - msgIdx, err
 	}
+	return n, nil
+}
+
+// consumed returns how much of a message of length msgLen was written, given
+// that n bytes of its formatted form were written, in which the message
+// starts at msgIdx (see FormatFn). Bytes of the prefix and suffix added by
+// FormatFn don't count. If the write succeeded, the whole message counts as
+// written, even if FormatFn changed its length.
+func consumed(n, msgIdx, msgLen int, err error) int {
+	switch {
+	case err == nil:
+		return msgLen
+	case n < msgIdx:
+		return 0
+	case n-msgIdx > msgLen:
+		return msgLen
+	default:
+		return n - msgIdx
+	}
+}
+
+// WriteTo copies the contents of the current logfile to w.
+//
+// The logfile is read through a separate read-only handle, so the append
+// position used by Write is never disturbed. Only the bytes written before
+// the call are copied, giving a consistent view even if writes continue or
+// the logfile is rotated meanwhile.
+func (me *Logger) WriteTo(w io.Writer) (int64, error) {
+	// The logfile is opened under the write lock, so that it's the one the
+	// size is taken from, but the copy is done without it
+	me.mu.Lock()
+	f, size, err := me.openLogfileSnapshot()
+	me.mu.Unlock()
+	if err != nil || f == nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return io.Copy(w, io.LimitReader(f, size))
+}
+
+// seqSuffix is the suffix of the sidecar file for SequenceSidecar.
+const seqSuffix = ".seq"
+
+// loadSeq resumes the sequence numbers from the sidecar file, if any.
+func (me *Logger) loadSeq() error {
+	data, err := ioutil.ReadFile(me.fpath() + seqSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read sequence file: %s", err)
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sequence file: %s", err)
+	}
+	me.seq = seq
+	return nil
+}
+
+// saveSeq saves the last sequence number to the sidecar file.
+func (me *Logger) saveSeq() error {
+	data := strconv.AppendUint(nil, me.seq, 10)
+	if err := ioutil.WriteFile(me.fpath()+seqSuffix, append(data, '\n'), me.fileMode()); err != nil {
+		return fmt.Errorf("can't write sequence file: %s", err)
+	}
+	return nil
+}
+
+// CurrentFileStart returns the time of the first write to the current
+// logfile since it was opened or rotated, or the zero time if there was none.
+func (me *Logger) CurrentFileStart() time.Time {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.fileStart
+}
+
+// CurrentFilename returns the absolute path of the logfile being written
+// to, or "" if none is open (e.g. before the first write).
+func (me *Logger) CurrentFilename() string {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.file == nil {
+		return ""
+	}
+	fpath, err := filepath.Abs(me.fpath())
+	if err != nil {
+		return filepath.Clean(me.fpath())
+	}
+	return fpath
+}
+
+// activeAgeLeft returns how long until the logfile is older than
+// MaxActiveAge, if it has any content (or RotateEmptyFiles is set).
+// Its age counts from the first write, or from when it was opened.
+func (me *Logger) activeAgeLeft() (time.Duration, bool) {
+	start := me.fileStart
+	if start.IsZero() {
+		if me.file == nil || !me.RotateEmptyFiles {
+			return 0, false
+		}
+		start = me.openedAt
+	}
+	return start.Add(me.MaxActiveAge).Sub(nowFn()), true
+}
+
+// isTooOld tells whether the logfile is older than MaxActiveAge.
+func (me *Logger) isTooOld() bool {
+	if me.MaxActiveAge <= 0 {
+		return false
+	}
+	left, ok := me.activeAgeLeft()
+	return ok && left <= 0
+}
+
+// isPastMaxLogAge tells whether the logfile was created more than MaxLogAge
+// ago.
+func (me *Logger) isPastMaxLogAge() bool {
+	return me.MaxLogAge > 0 && nowFn().Sub(me.openedAt) >= me.MaxLogAge
+}
+
+// rotateIfTooOld rotates the logfile if it's older than MaxActiveAge,
+// even if nothing is being written. It is called by the mill.
+func (me *Logger) rotateIfTooOld() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	isDue := me.isTooOld()
+	if me.TriggerPolicy != nil {
+		isDue = me.isRotationDue(0)
+	}
+	if me.file == nil || !isDue {
+		return
+	}
+	if err := me.rotate(); err != nil {
+		me.reportError("rotate", err)
+	}
+}
+
+// Triggers are the rotation triggers evaluated before a write, as given to
+// TriggerPolicy.
+type Triggers struct {
+	// Size is the size the logfile would have after the write.
+	Size int64
+
+	// Age is the time since the first write to the logfile (or zero).
+	Age time.Duration
+
+	// SizeExceeded tells whether Size is over the size limit.
+	SizeExceeded bool
+
+	// TooOld tells whether the logfile is older than MaxActiveAge or
+	// MaxLogAge.
+	TooOld bool
+
+	// Custom tells whether ShouldRotate returned true.
+	Custom bool
+}
+
+// isRotationDue tells whether the logfile should be rotated before writing
+// writeLen bytes to it. Without a TriggerPolicy, any trigger rotates it.
+func (me *Logger) isRotationDue(writeLen int64) bool {
+	if me.TriggerPolicy == nil {
+		return me.isPastMaxLogAge() || me.size+writeLen > me.maxLogSize() || me.shouldRotate() || me.isTooOld()
+	}
+
+	triggers := Triggers{
+		Size:         me.size + writeLen,
+		SizeExceeded: me.size+writeLen > me.maxLogSize(),
+		TooOld:       me.isTooOld() || me.isPastMaxLogAge(),
+		Custom:       me.shouldRotate(),
+	}
+	if !me.fileStart.IsZero() {
+		triggers.Age = nowFn().Sub(me.fileStart)
+	}
+	return me.TriggerPolicy(triggers)
+}
+
+// shouldRotate consults the ShouldRotate callback, if any.
+func (me *Logger) shouldRotate() bool {
+	return me.ShouldRotate != nil && me.ShouldRotate(me.size, nowFn().Sub(me.openedAt))
+}
+
+// recoverNoSpace handles a write of msg that failed with ENOSPC after writing
+// n bytes. It removes the oldest archive to free up space and retries the
+// rest of the write once. If that fails too, the partially written record is
+// truncated away (where possible) so that the logfile only has whole records.
+func (me *Logger) recoverNoSpace(msg []byte, n int, err error) (int, error) {
+	removed, pruneErr := me.pruneOldest()
+	if pruneErr != nil {
+		me.reportError("Write", pruneErr)
+	}
+	if removed != "" {
+		me.reportError("Write", fmt.Errorf("no space left on device, removed oldest archive %s", removed))
+		var m int
+		m, err = me.writeFull(msg[n:])
+		n += m
+		if err == nil {
+			return n, nil
+		}
+	}
+
+	if truncater, ok := me.file.(interface{ Truncate(int64) error }); ok {
+		if truncErr := truncater.Truncate(me.size); truncErr != nil {
+			me.reportError("Write", fmt.Errorf("can't truncate partial write: %s", truncErr))
+		} else {
+			n = 0
+		}
+	}
+	me.reportError("Write", err)
 	return n, err
 }
 
+// recoverBadFile handles a write of msg that failed with EBADF or EIO after
+// writing n bytes, as when the device of the logfile went away. It reopens
+// the logfile once and retries the rest of the write.
+func (me *Logger) recoverBadFile(msg []byte, n int, err error) (int, error) {
+	me.file.Close()
+	file, openErr := openFileFn(me.fpath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY|me.OpenFlags, me.fileMode())
+	if openErr != nil {
+		me.reportError("Write", fmt.Errorf("can't reopen log file after %v: %s", err, openErr))
+		me.file = nil
+		return n, err
+	}
+	size, seekErr := file.Seek(0, io.SeekEnd)
+	if seekErr != nil {
+		file.Close()
+		me.reportError("Write", fmt.Errorf("can't reopen log file after %v: %s", err, seekErr))
+		me.file = nil
+		return n, err
+	}
+	me.reportError("Write", fmt.Errorf("reopened log file after %v", err))
+	me.file = me.bufferFile(file)
+	me.size = size - int64(n)
+
+	m, err := me.writeFull(msg[n:])
+	return n + m, err
+}
+
 func (me *Logger) closeFile() error {
 	var ERR error
 
@@ -87,7 +632,7 @@ func (me *Logger) closeFile() error {
 		return nil
 	}
 
-	err := me.Flush()
+	err := me.flush()
 	if ERR == nil {
 		ERR = err
 	}
@@ -98,11 +643,41 @@ func (me *Logger) closeFile() error {
 	}
 	me.file = nil
 
+	if me.SequenceNumbers && me.SequenceSidecar {
+		if err := me.saveSeq(); err != nil {
+			me.reportError("closeFile", err)
+		}
+	}
+
 	return ERR
 }
 func (me *Logger) Close() error {
+	me.stopAsync()
+	me.stopSignals()
+	me.mu.Lock()
 	err := me.closeFile()
+	me.closeStandby()
+	me.mu.Unlock()
 	me.StopMill()
 
 	return err
 }
+
+// CloseContext is like Close, but only waits for the mill to finish until ctx
+// is done. In that case, any compression in progress is abandoned and
+// ctx.Err() is returned. The uncompressed archive is kept, and is compressed
+// on the next start.
+func (me *Logger) CloseContext(ctx context.Context) error {
+	me.stopAsync()
+	me.stopSignals()
+	me.mu.Lock()
+	err := me.closeFile()
+	me.closeStandby()
+	me.mu.Unlock()
+
+	if ctxErr := me.Shutdown(ctx); ctxErr != nil {
+		me.abandonMill()
+		return ctxErr
+	}
+	return err
+}
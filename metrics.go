@@ -0,0 +1,70 @@
+package tumble
+
+import "time"
+
+// Metrics receives measurements of the mill, e.g. for SLO tracking.
+type Metrics interface {
+	// ObserveMillDuration is called with the duration of each mill pass.
+	ObserveMillDuration(d time.Duration)
+
+	// SetMillBacklog is called with the number of uncompressed archives
+	// waiting for the mill, whenever it changes during a mill pass.
+	SetMillBacklog(n int)
+}
+
+// Stats is a snapshot of the Logger's state.
+type Stats struct {
+	// MillBacklog is the number of uncompressed archives waiting for the mill,
+	// as of its latest pass. It grows when compression can't keep up.
+	MillBacklog int
+
+	// CurrentSize is the size of the logfile (in bytes).
+	CurrentSize int64
+
+	// Rotations is the number of rotations since the Logger was created.
+	Rotations uint64
+
+	// BackupCount and TotalBackupBytes are the number of archives in the
+	// log directory and their total size (in bytes). Both are zero if the
+	// log directory can't be read.
+	BackupCount      int
+	TotalBackupBytes int64
+}
+
+// Stats returns a snapshot of the Logger's state. The archives are counted
+// by reading the log directory.
+func (me *Logger) Stats() Stats {
+	me.mu.Lock()
+	stats := Stats{
+		CurrentSize: me.size,
+		Rotations:   me.rotations,
+	}
+	me.mu.Unlock()
+
+	me.statsMu.Lock()
+	stats.MillBacklog = me.millBacklog
+	me.statsMu.Unlock()
+
+	if files, err := me.oldLogFiles(); err == nil {
+		stats.BackupCount = len(files)
+		for _, f := range files {
+			stats.TotalBackupBytes += f.Size()
+		}
+	}
+	return stats
+}
+
+func (me *Logger) setMillBacklog(n int) {
+	me.statsMu.Lock()
+	me.millBacklog = n
+	me.statsMu.Unlock()
+	if me.Metrics != nil {
+		me.Metrics.SetMillBacklog(n)
+	}
+}
+
+func (me *Logger) observeMillDuration(d time.Duration) {
+	if me.Metrics != nil {
+		me.Metrics.ObserveMillDuration(d)
+	}
+}
@@ -1,19 +1,25 @@
 package tumble
 
 import (
-	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// ErrBackupTooLarge is reported when a single compressed archive doesn't fit
+// within MaxTotalSizeMB (less MaxLogSizeMB), so no history can be retained.
+var ErrBackupTooLarge = errors.New("compressed archive exceeds the total size limit")
+
 type logInfo struct {
 	os.FileInfo
 	timestamp time.Time
@@ -31,8 +37,8 @@ func (b byFormatTime) Less(i, j int) bool {
 	return b[i].timestamp.After(b[j].timestamp)
 }
 
-func compressLogFile(src string) (err error) {
-	dst := src + compressSuffix
+func (me *Logger) compressLogFile(src string) (err error) {
+	dst := src + me.archiveSuffix()
 
 	f, err := os.Open(src)
 	if err != nil {
@@ -40,37 +46,73 @@ func compressLogFile(src string) (err error) {
 	}
 	defer f.Close()
 
-	_, err = os.Stat(src)
+	info, err := os.Stat(src)
 	if err != nil {
 		return fmt.Errorf("failed to stat log file: %v", err)
 	}
 
-	// If this file already exists, we presume it was created by
+	// The archive is compressed under a temporary name, and only renamed
+	// once it's complete, so a crash can't leave a partial archive behind.
+	// If the temporary file already exists, we presume it was created by
 	// a previous attempt to compress the log file.
-	gzf, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(fileMode))
+	tmp := dst + compressTmpSuffix
+	gzf, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, me.fileMode())
 	if err != nil {
 		return fmt.Errorf("failed to open compressed log file: %v", err)
 	}
 	defer gzf.Close()
 
-	gz := gzip.NewWriter(gzf)
-
 	defer func() {
 		if err != nil {
-			os.Remove(dst)
-			err = fmt.Errorf("failed to compress log file: %v", err)
+			os.Remove(tmp)
+			err = fmt.Errorf("failed to compress log file: %w", err)
 		}
 	}()
+	if me.CopyFileMetadata {
+		if err := gzf.Chmod(info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := chown(tmp, info); err != nil {
+			return err
+		}
+	}
+	r := abandonableReader{me, f}
+
+	var w io.WriteCloser = gzf
+	if me.Encrypter != nil {
+		if w, err = me.Encrypter.NewWriter(gzf); err != nil {
+			return err
+		}
+	}
+	cw, err := me.compression().NewWriter(w)
+	if err != nil {
+		return err
+	}
 
-	if _, err := io.Copy(gz, f); err != nil {
+	if me.TransformBackup != nil {
+		if err := me.TransformBackup(r, cw); err != nil {
+			return err
+		}
+	} else if _, err := io.CopyBuffer(cw, r, me.compressBuffer()); err != nil {
 		return err
 	}
-	if err := gz.Close(); err != nil {
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if w != gzf {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	if err := gzf.Sync(); err != nil {
 		return err
 	}
 	if err := gzf.Close(); err != nil {
 		return err
 	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
 
 	if err := f.Close(); err != nil {
 		return err
@@ -82,17 +124,151 @@ func compressLogFile(src string) (err error) {
 	return nil
 }
 
+// isCompressDue tells whether an uncompressed archive is older than
+// CompressDelay. If not, it's due at compressDue (at the earliest).
+func (me *Logger) isCompressDue(f logInfo) bool {
+	if me.CompressDelay <= 0 {
+		return true
+	}
+	due := f.timestamp.Add(me.CompressDelay)
+	if !nowFn().Before(due) {
+		return true
+	}
+	if me.compressDue.IsZero() || due.Before(me.compressDue) {
+		me.compressDue = due
+	}
+	return false
+}
+
+// errMillAbandoned is returned by reads during compression once CloseContext
+// has given up on waiting for the mill.
+var errMillAbandoned = errors.New("mill abandoned")
+
+// abandonableReader fails once the mill is abandoned, so that the mill
+// stops as soon as possible.
+type abandonableReader struct {
+	logger *Logger
+	r      io.Reader
+}
+
+func (me abandonableReader) Read(p []byte) (int, error) {
+	if me.logger.isAbandoned() {
+		return 0, errMillAbandoned
+	}
+	return me.r.Read(p)
+}
+
+func (me *Logger) abandonMill() {
+	me.abandonMu.Lock()
+	me.isMillAbandoned = true
+	me.abandonMu.Unlock()
+}
+
+func (me *Logger) isAbandoned() bool {
+	me.abandonMu.Lock()
+	defer me.abandonMu.Unlock()
+	return me.isMillAbandoned
+}
+
+// compression returns the Compression of new archives.
+func (me *Logger) compression() Compression {
+	if me.Compression == nil {
+		return Gzip{me.GzipComment, me.CompressLevel}
+	}
+	return me.Compression
+}
+
+// archiveSuffix is the suffix of compressed (and possibly encrypted) archives.
+func (me *Logger) archiveSuffix() string {
+	if me.Encrypter != nil {
+		return me.compression().Extension() + me.Encrypter.Suffix()
+	}
+	return me.compression().Extension()
+}
+
+// archiveExt returns the suffix which makes name a compressed (and possibly
+// encrypted) archive, or "" if it's uncompressed. Archives compressed with
+// any registered Compression are recognized, and unencrypted ones are still
+// recognized after Encrypter is set.
+func (me *Logger) archiveExt(name string) string {
+	encSuffix := ""
+	if me.Encrypter != nil && strings.HasSuffix(name, me.Encrypter.Suffix()) {
+		encSuffix = me.Encrypter.Suffix()
+	}
+	return compressionExt(name[:len(name)-len(encSuffix)], me.compression()) + encSuffix
+}
+
+// isCompressed tells whether name is a compressed archive. Without
+// compression (or encryption), every archive is final as it is.
+func (me *Logger) isCompressed(name string) bool {
+	return me.archiveSuffix() == "" || me.archiveExt(name) != ""
+}
+
+// errNoDecrypter is returned by openBackup for encrypted archives when the
+// Encrypter can't decrypt them.
+var errNoDecrypter = errors.New("Encrypter is not a Decrypter")
+
+// openBackup opens a compressed (and possibly encrypted) archive for reading
+// its original content.
+func (me *Logger) openBackup(fpath string) (io.ReadCloser, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = f
+	ext := me.archiveExt(fpath)
+	if me.Encrypter != nil && strings.HasSuffix(ext, me.Encrypter.Suffix()) {
+		decrypter, ok := me.Encrypter.(Decrypter)
+		if !ok {
+			f.Close()
+			return nil, errNoDecrypter
+		}
+		if r, err = decrypter.NewReader(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		ext = ext[:len(ext)-len(me.Encrypter.Suffix())]
+	}
+	dr, err := newDecompressReader(r, ext, me.compression())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{dr, f}, nil
+}
+
+// compressBuffer returns the buffer used to stream a logfile into compression.
+// Compression memory usage is independent of the logfile size.
+func (me *Logger) compressBuffer() []byte {
+	size := me.CompressBufferSize
+	if size <= 0 {
+		size = defaultCompressBufferSize
+	}
+	return make([]byte, size)
+}
+
 func (me *Logger) dir() string {
-	return filepath.Dir(me.Filepath)
+	return filepath.Dir(me.fpath())
 }
 
 func (me *Logger) prefixAndExt() (prefix, ext string) {
-	filename := filepath.Base(me.Filepath)
+	filename := filepath.Base(me.fpath())
 	ext = filepath.Ext(filename)
 	prefix = filename[:len(filename)-len(ext)] + "-"
 	return prefix, ext
 }
 
+// layout is the layout of the time in archive names.
+func (me *Logger) layout() timestampLayout {
+	if me.LocalTime {
+		return timestampLayout{me.TimestampResolution, me.TimestampFormat, time.Local}
+	}
+	return timestampLayout{me.TimestampResolution, me.TimestampFormat, time.UTC}
+}
+
 func (me *Logger) timeFromName(filename, prefix, ext string) (time.Time, error) {
 	if !strings.HasPrefix(filename, prefix) {
 		return time.Time{}, errors.New("mismatched prefix")
@@ -101,15 +277,31 @@ func (me *Logger) timeFromName(filename, prefix, ext string) (time.Time, error)
 		return time.Time{}, errors.New("mismatched extension")
 	}
 	ts := filename[len(prefix) : len(filename)-len(ext)]
-	secs, err := strconv.ParseInt(ts, 10, 64)
-	if err != nil {
-		return time.Time{}, errors.New("invalid timestamp")
+	t, err := me.layout().parse(ts)
+	if err == nil {
+		return t, nil
+	}
+
+	// A counter may have been appended to avoid a name collision. It sorts
+	// the archive after the others with the same time.
+	if i := strings.LastIndexByte(ts, '.'); i > 0 {
+		n, nerr := strconv.ParseInt(ts[i+1:], 10, 64)
+		if t, err := me.layout().parse(ts[:i]); err == nil && nerr == nil && n > 0 && n < maxCounter {
+			return t.Add(time.Duration(n)), nil
+		}
 	}
-	return time.Unix(secs, 0).UTC(), nil
+	return time.Time{}, err
 }
 
 func (me *Logger) oldLogFiles() ([]logInfo, error) {
-	files, err := ioutil.ReadDir(me.dir())
+	return me.oldLogFilesIn(me.dir())
+}
+
+// oldLogFilesIn returns the archives in dir, which is the log directory
+// or one of the Mirror directories. With SubdirLayout, the archives in its
+// subdirectories are included, and their names are relative to dir.
+func (me *Logger) oldLogFilesIn(dir string) ([]logInfo, error) {
+	files, err := me.readBackupDir(dir)
 	if err != nil {
 		return nil, fmt.Errorf("can't read log file directory: %s", err)
 	}
@@ -121,11 +313,8 @@ func (me *Logger) oldLogFiles() ([]logInfo, error) {
 		if f.IsDir() {
 			continue
 		}
-		if t, err := me.timeFromName(f.Name(), prefix, ext); err == nil {
-			logFiles = append(logFiles, logInfo{f, t})
-			continue
-		}
-		if t, err := me.timeFromName(f.Name(), prefix, ext+compressSuffix); err == nil {
+		name := filepath.Base(f.Name())
+		if t, err := me.timeFromName(name, prefix, ext+me.archiveExt(name)); err == nil {
 			logFiles = append(logFiles, logInfo{f, t})
 			continue
 		}
@@ -138,34 +327,156 @@ func (me *Logger) oldLogFiles() ([]logInfo, error) {
 	return logFiles, nil
 }
 
+// isCompressedAlready tells whether the uncompressed archive f has a
+// compressed counterpart which is complete (e.g. the mill was interrupted
+// before removing f). If so, f is removed rather than compressed again.
+func (me *Logger) isCompressedAlready(f logInfo) bool {
+	fn := filepath.Join(me.dir(), f.Name())
+	if _, err := os.Stat(fn + me.archiveSuffix()); err != nil {
+		return false
+	}
+	if err := me.verifyBackup(fn + me.archiveSuffix()); err != nil {
+		return false
+	}
+	if err := os.Remove(fn); err != nil {
+		me.reportError("millRunOnce", fmt.Errorf("can't remove compressed archive: %s", err))
+		return false
+	}
+	return true
+}
+
+// compressAll compresses the given archives, returning the error for each.
+// With CompressWorkers, up to that many are compressed at once. Otherwise,
+// they're compressed in order. A failure doesn't stop the others from being
+// compressed, unless the mill is abandoned.
+func (me *Logger) compressAll(files []logInfo) []error {
+	errs := make([]error, len(files))
+	if me.CompressWorkers <= 1 {
+		for i, f := range files {
+			errs[i] = me.compressWithRetry(filepath.Join(me.dir(), f.Name()))
+			if errors.Is(errs[i], errMillAbandoned) {
+				return errs[:i+1]
+			}
+		}
+		return errs
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < me.CompressWorkers && w < len(files); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = me.compressWithRetry(filepath.Join(me.dir(), files[i].Name()))
+			}
+		}()
+	}
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
+}
+
+// compressWithRetry compresses the archive at src, retrying up to
+// CompressRetries times on failure, with the delay doubling each time.
+func (me *Logger) compressWithRetry(src string) error {
+	backoff := me.CompressBackoff
+	if backoff <= 0 {
+		backoff = defaultCompressBackoff
+	}
+	err := me.compressLogFile(src)
+	for i := 0; err != nil && i < me.CompressRetries && !errors.Is(err, errMillAbandoned); i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = me.compressLogFile(src)
+	}
+	return err
+}
+
 func (me *Logger) millRunOnce() error {
+	me.millMu.Lock()
+	defer me.millMu.Unlock()
+
 	oldFiles, err := me.oldLogFiles()
 	if err != nil {
 		return err
 	}
 
+	// Under heavy write load, compression is deferred (but retention isn't)
+	me.isMillDeferred = me.MillDeferRate > 0 && me.writeRate() > me.MillDeferRate
+
+	if me.CoalesceBackups && !me.isMillDeferred {
+		if oldFiles, err = me.coalesce(oldFiles); err != nil {
+			return err
+		}
+	}
+
 	// It is possible to have both an uncompressed and (partially) compressed file for the same log
-	// In this case, we overwrite the compressed file with a new one in compressLogFile().
+	// In this case, we overwrite the compressed file with a new one in compressLogFile(),
+	// unless it's complete (see isCompressedAlready).
 	// We overwrite keys over two passes on a map to ensure that logInfo entries are the current ones.
 	compressedMap := make(map[time.Time]logInfo)
+	backlog := 0
 	for _, f := range oldFiles {
-		if strings.HasSuffix(f.Name(), compressSuffix) {
+		if me.isCompressed(f.Name()) {
 			compressedMap[f.timestamp] = f
+		} else {
+			backlog++
 		}
 	}
+	me.setMillBacklog(backlog)
+	me.compressDue = time.Time{}
+	due := []logInfo{}
 	for _, f := range oldFiles {
-		if !strings.HasSuffix(f.Name(), compressSuffix) {
-			fn := filepath.Join(me.dir(), f.Name())
-			err := compressLogFile(fn)
-			if err != nil {
-				return err
-			}
-			fi, err := os.Stat(fn + compressSuffix)
-			if err != nil {
-				return err
-			}
-			compressedMap[f.timestamp] = logInfo{fi, f.timestamp}
+		if me.isCompressed(f.Name()) || me.isMillDeferred || !me.isCompressDue(f) {
+			continue
+		}
+		if me.isCompressedAlready(f) {
+			backlog--
+			me.setMillBacklog(backlog)
+			continue
+		}
+		due = append(due, f)
+	}
+	// Whatever happens after compression is done here, one archive at a time.
+	// An archive that fails to compress is reported and left uncompressed,
+	// but doesn't keep retention from being enforced on the others.
+	for i, err := range me.compressAll(due) {
+		f := due[i]
+		fn := filepath.Join(me.dir(), f.Name())
+		if me.OnCompress != nil {
+			me.OnCompress(fn+me.archiveSuffix(), err)
+		}
+		if errors.Is(err, errMillAbandoned) {
+			return err
+		}
+		if err != nil {
+			me.reportError("millRunOnce", err)
+			continue
+		}
+		fi, err := os.Stat(fn + me.archiveSuffix())
+		if err != nil {
+			return err
+		}
+		compressedMap[f.timestamp] = logInfo{fi, f.timestamp}
+		backlog--
+		me.setMillBacklog(backlog)
+		me.mirror(fn + me.archiveSuffix())
+		me.postRotate(fn + me.archiveSuffix())
+	}
+	// Without compression, archives are final as soon as they're rotated
+	for _, fn := range me.takeFinalized() {
+		if _, err := os.Stat(fn); err != nil {
+			continue
+		}
+		if me.OnCompress != nil {
+			me.OnCompress(fn, nil)
 		}
+		me.mirror(fn)
+		me.postRotate(fn)
 	}
 
 	// Sort logInfo entries and discard the oldest once the maximum storage size has been exhausted.
@@ -177,18 +488,457 @@ func (me *Logger) millRunOnce() error {
 	}
 	sort.Sort(byFormatTime(compressedFiles))
 
+	expired, err := me.expire(me.dir(), compressedFiles)
+	if err != nil {
+		return err
+	}
+	me.expireMirrors(expired)
+
+	return nil
+}
+
+// BucketPeriod groups archives by the time in their name, for retention
+// per bucket with PerBucketKeep.
+type BucketPeriod int
+
+const (
+	// BucketNone doesn't group archives (the default).
+	BucketNone BucketPeriod = iota
+
+	// BucketDay groups archives by UTC day.
+	BucketDay
+
+	// BucketHour groups archives by hour.
+	BucketHour
+)
+
+func (me BucketPeriod) duration() time.Duration {
+	switch me {
+	case BucketDay:
+		return 24 * time.Hour
+	case BucketHour:
+		return time.Hour
+	default:
+		return 0
+	}
+}
+
+// expire removes the compressed archives in dir which exceed the retention
+// limits, and returns their names. The archives are sorted from newest to oldest.
+// Archives thinned out of their bucket (per BucketBy) don't count towards the
+// other limits.
+func (me *Logger) expire(dir string, compressedFiles []logInfo) ([]string, error) {
+	// The age cutoff is only meaningful when MaxAge is set
+	var cutoff time.Time
+	if me.MaxAge > 0 {
+		cutoff = nowFn().Add(-time.Duration(me.MaxAge) * 24 * time.Hour)
+	}
+
+	expired := []string{}
+	buckets := make(map[time.Time]int)
 	totalSizeBytes := int64(0)
+	kept := 0
 	for _, f := range compressedFiles {
-		totalSizeBytes += f.Size()
-		if totalSizeBytes > int64((me.MaxTotalSizeMB-me.MaxLogSizeMB)*MB) {
-			err := os.Remove(filepath.Join(me.dir(), f.Name()))
+		isExpired := false
+		if period := me.BucketBy.duration(); period > 0 && me.PerBucketKeep > 0 {
+			bucket := f.timestamp.UTC().Truncate(period)
+			buckets[bucket]++
+			isExpired = buckets[bucket] > me.PerBucketKeep
+		}
+		if !isExpired {
+			totalSizeBytes += f.Size()
+			if me.MaxTotalSizeMB > 0 && totalSizeBytes > int64(me.MaxTotalSizeMB*MB)-me.maxLogSize() {
+				// If even the newest archive doesn't fit, retention would throw away
+				// all history. This is a configuration problem, so we say so (once).
+				if kept == 0 {
+					if !me.isBudgetWarned {
+						me.isBudgetWarned = true
+						me.reportError("millRunOnce", fmt.Errorf("%w: %s is %d bytes", ErrBackupTooLarge, f.Name(), f.Size()))
+					}
+					isExpired = !me.KeepNewestBackup
+				} else {
+					isExpired = true
+				}
+			}
+			if me.MaxBackups > 0 && kept >= me.MaxBackups {
+				isExpired = true
+			}
+			kept++
+		}
+		if me.MaxAge > 0 && f.timestamp.Before(cutoff) {
+			isExpired = true
+		}
+		if isExpired {
+			err := os.Remove(filepath.Join(dir, f.Name()))
 			if err != nil {
-				return err
+				return expired, err
+			}
+			expired = append(expired, f.Name())
+			if me.SubdirLayout != "" {
+				removeEmptyDirs(dir, filepath.Dir(f.Name()))
 			}
 		}
 	}
 
-	return nil
+	return expired, nil
+}
+
+// addFinalized queues a rotated archive which needs no compression, so that
+// the mill runs the hooks for it (OnCompress, Mirror and PostRotate).
+func (me *Logger) addFinalized(fpath string) {
+	me.finalizedMu.Lock()
+	defer me.finalizedMu.Unlock()
+	me.finalized = append(me.finalized, fpath)
+}
+
+// takeFinalized returns (and clears) the archives queued by addFinalized.
+func (me *Logger) takeFinalized() []string {
+	me.finalizedMu.Lock()
+	defer me.finalizedMu.Unlock()
+	finalized := me.finalized
+	me.finalized = nil
+	return finalized
+}
+
+// mirror copies a compressed archive to each of the Mirror directories.
+// Failures are reported, but don't stop the mill.
+func (me *Logger) mirror(fpath string) {
+	for _, dir := range me.Mirror {
+		if err := copyFile(fpath, filepath.Join(dir, filepath.Base(fpath)), me.fileMode()); err != nil {
+			me.reportError("mirror", fmt.Errorf("can't copy %s to mirror: %s", filepath.Base(fpath), err))
+		}
+	}
+}
+
+// expireMirrors applies retention to the Mirror directories: either by
+// removing the same archives as were expired from the log directory (with
+// MirrorLockstep), or by applying the retention limits to each of them.
+func (me *Logger) expireMirrors(expired []string) {
+	for _, dir := range me.Mirror {
+		if me.MirrorLockstep {
+			for _, name := range expired {
+				// Mirrors are flat, even with SubdirLayout
+				if err := os.Remove(filepath.Join(dir, filepath.Base(name))); err != nil && !os.IsNotExist(err) {
+					me.reportError("mirror", err)
+				}
+			}
+			continue
+		}
+
+		oldFiles, err := me.oldLogFilesIn(dir)
+		if err != nil {
+			me.reportError("mirror", err)
+			continue
+		}
+		compressedFiles := make([]logInfo, 0, len(oldFiles))
+		for _, f := range oldFiles {
+			if me.isCompressed(f.Name()) {
+				compressedFiles = append(compressedFiles, f)
+			}
+		}
+		if _, err := me.expire(dir, compressedFiles); err != nil {
+			me.reportError("mirror", err)
+		}
+	}
+}
+
+// DiskUsage returns the total size (in bytes) of the files managed by the
+// Logger: the logfile, its archives (compressed or not, found the same way as
+// by retention), and the PreviousName copy and sequence file, if any.
+func (me *Logger) DiskUsage() (int64, error) {
+	oldFiles, err := me.oldLogFiles()
+	if err != nil {
+		return 0, err
+	}
+	total := int64(0)
+	for _, f := range oldFiles {
+		total += f.Size()
+	}
+
+	fpaths := []string{me.fpath()}
+	if me.PreviousName != "" {
+		fpaths = append(fpaths, me.fpath()+me.PreviousName)
+	}
+	if me.SequenceSidecar {
+		fpaths = append(fpaths, me.fpath()+seqSuffix)
+	}
+	for _, fpath := range fpaths {
+		info, err := os.Stat(fpath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("can't get file info: %s", err)
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+// coalesceSize is the size (in bytes) up to which uncompressed archives are
+// coalesced, honoring the default of 10 logfiles.
+func (me *Logger) coalesceSize() int64 {
+	if me.CoalesceSizeMB > 0 {
+		return int64(me.CoalesceSizeMB * MB)
+	}
+	return 10 * me.maxLogSize()
+}
+
+// coalesce appends each uncompressed archive to the previous one, as long as
+// it fits within coalesceSize, and returns the remaining archives. The newest
+// uncompressed archive is left out (so it isn't compressed yet) unless it's
+// full or the mill is stopping.
+func (me *Logger) coalesce(oldFiles []logInfo) ([]logInfo, error) {
+	target := me.coalesceSize()
+	remaining := make([]logInfo, 0, len(oldFiles))
+
+	var acc logInfo
+	accSize := int64(0)
+	// oldFiles is sorted from newest to oldest
+	for i := len(oldFiles) - 1; i >= 0; i-- {
+		f := oldFiles[i]
+		if me.isCompressed(f.Name()) {
+			remaining = append(remaining, f)
+			continue
+		}
+		if acc.FileInfo != nil && accSize+f.Size() <= target {
+			dst := filepath.Join(me.dir(), acc.Name())
+			if err := appendFile(dst, filepath.Join(me.dir(), f.Name())); err != nil {
+				return nil, fmt.Errorf("can't coalesce %s: %s", f.Name(), err)
+			}
+			accSize += f.Size()
+			continue
+		}
+		if acc.FileInfo != nil {
+			remaining = append(remaining, acc)
+		}
+		acc = f
+		accSize = f.Size()
+	}
+	if acc.FileInfo != nil && (accSize >= target || me.isMillStopping) {
+		remaining = append(remaining, acc)
+	}
+
+	sort.Sort(byFormatTime(remaining))
+	return remaining, nil
+}
+
+// appendFile appends the content of src to dst, and removes src.
+func appendFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_APPEND|os.O_WRONLY, defaultFileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+// DeleteBackups removes the archives (compressed or not) for which pred
+// returns true, and returns the paths of the removed files. This is meant for
+// removing specific archives outside of the normal retention limits.
+// It never runs concurrently with the mill.
+func (me *Logger) DeleteBackups(pred func(BackupInfo) bool) ([]string, error) {
+	me.millMu.Lock()
+	defer me.millMu.Unlock()
+
+	oldFiles, err := me.oldLogFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := []string{}
+	for _, f := range oldFiles {
+		fpath := filepath.Join(me.dir(), f.Name())
+		if !pred(BackupInfo{fpath, f.timestamp, f.Size()}) {
+			continue
+		}
+		if err := os.Remove(fpath); err != nil {
+			return deleted, fmt.Errorf("can't remove backup: %s", err)
+		}
+		deleted = append(deleted, fpath)
+	}
+	return deleted, nil
+}
+
+// pruneOldest removes the oldest archive (compressed or not), regardless of
+// the retention limits, and returns its path. It returns "" if there are none.
+func (me *Logger) pruneOldest() (string, error) {
+	me.millMu.Lock()
+	defer me.millMu.Unlock()
+
+	oldFiles, err := me.oldLogFiles()
+	if err != nil || len(oldFiles) == 0 {
+		return "", err
+	}
+	fpath := filepath.Join(me.dir(), oldFiles[len(oldFiles)-1].Name())
+	if err := os.Remove(fpath); err != nil {
+		return "", fmt.Errorf("can't remove backup: %s", err)
+	}
+	return fpath, nil
+}
+
+// postRotate runs the PostRotate and ExecPostRotate hooks for a compressed
+// archive. Their errors are reported, but don't stop the mill.
+func (me *Logger) postRotate(backup string) {
+	if me.PostRotate != nil {
+		if err := me.PostRotate(backup); err != nil {
+			me.reportError("postRotate", err)
+		}
+	}
+	if len(me.ExecPostRotate) > 0 {
+		argv := append(me.ExecPostRotate[1:len(me.ExecPostRotate):len(me.ExecPostRotate)], backup)
+		out, err := exec.Command(me.ExecPostRotate[0], argv...).CombinedOutput()
+		if err != nil {
+			me.reportError("postRotate", fmt.Errorf("%s failed: %v: %q", me.ExecPostRotate[0], err, out))
+		}
+	}
+}
+
+// ensureFreeInodes removes the oldest archives, regardless of the retention
+// limits, until MinFreeInodes would remain free after creating a new logfile.
+func (me *Logger) ensureFreeInodes() {
+	for {
+		free, err := freeInodesFn(me.dir())
+		if err != nil {
+			me.reportError("ensureFreeInodes", err)
+			return
+		}
+		if free > me.MinFreeInodes {
+			return
+		}
+		removed, err := me.pruneOldest()
+		if err != nil {
+			me.reportError("ensureFreeInodes", err)
+			return
+		}
+		if removed == "" {
+			return
+		}
+		me.reportError("ensureFreeInodes", fmt.Errorf("low on inodes (%d free), removed oldest archive %s", free, removed))
+	}
+}
+
+// ensureFreeBytes removes the oldest archives, regardless of the retention
+// limits, until MinFreeBytes would remain free after writing n bytes. If
+// that's not possible, it returns ErrDiskFull.
+func (me *Logger) ensureFreeBytes(n int64) error {
+	for {
+		free, err := freeBytesFn(me.dir())
+		if err != nil {
+			me.reportError("ensureFreeBytes", err)
+			return nil
+		}
+		if free >= uint64(me.MinFreeBytes+n) {
+			return nil
+		}
+		removed, err := me.pruneOldest()
+		if err != nil {
+			me.reportError("ensureFreeBytes", err)
+			return ErrDiskFull
+		}
+		if removed == "" {
+			return ErrDiskFull
+		}
+		me.reportError("ensureFreeBytes", fmt.Errorf("low on disk space (%d bytes free), removed oldest archive %s", free, removed))
+	}
+}
+
+// addWriteRate records n bytes written, for writeRate.
+func (me *Logger) addWriteRate(n int) {
+	me.rateMu.Lock()
+	me.rateBytes += int64(n)
+	me.rateMu.Unlock()
+}
+
+// writeRate returns the write rate (in bytes/sec) since the previous call,
+// or that of the previous call if it was less than rateWindow ago.
+func (me *Logger) writeRate() int64 {
+	me.rateMu.Lock()
+	defer me.rateMu.Unlock()
+
+	now := nowFn()
+	elapsed := now.Sub(me.rateStart)
+	if elapsed < rateWindow {
+		return me.rate
+	}
+	me.rate = me.rateBytes * int64(time.Second) / int64(elapsed)
+	me.rateStart = now
+	me.rateBytes = 0
+	return me.rate
+}
+
+// reportError hands an error from background work to OnError,
+// or writes it to Diagnostics if OnError is nil.
+func (me *Logger) reportError(where string, err error) {
+	me.queueError(err)
+	if me.OnError != nil {
+		me.OnError(err)
+		return
+	}
+	me.diagnose(where, err)
+}
+
+// errorsQueueSize is how many errors Errors holds before dropping them.
+const errorsQueueSize = 64
+
+// Errors returns a channel of the errors from background work (mostly the
+// mill), which are also given to OnError. Consuming it is optional: errors
+// are dropped while it's full. It's closed once StopMill completes.
+func (me *Logger) Errors() <-chan error {
+	me.errorsMu.Lock()
+	defer me.errorsMu.Unlock()
+	if me.errorsCh == nil {
+		me.errorsCh = make(chan error, errorsQueueSize)
+		if me.isErrorsClosed {
+			close(me.errorsCh)
+		}
+	}
+	return me.errorsCh
+}
+
+// queueError sends err on the Errors channel (if any), unless it's full.
+func (me *Logger) queueError(err error) {
+	me.errorsMu.Lock()
+	defer me.errorsMu.Unlock()
+	if me.errorsCh == nil || me.isErrorsClosed {
+		return
+	}
+	select {
+	case me.errorsCh <- err:
+	default:
+	}
+}
+
+// closeErrors closes the Errors channel (if any).
+func (me *Logger) closeErrors() {
+	me.errorsMu.Lock()
+	defer me.errorsMu.Unlock()
+	if me.errorsCh != nil && !me.isErrorsClosed {
+		close(me.errorsCh)
+	}
+	me.isErrorsClosed = true
+}
+
+// diagnose writes an operational message about the logger itself to
+// Diagnostics (default: stderr).
+func (me *Logger) diagnose(where string, err error) {
+	w := me.Diagnostics
+	if w == nil {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "error in tumble/%s: %v\n", where, err)
 }
 
 func (me *Logger) drainMillCh() {
@@ -206,30 +956,173 @@ func (me *Logger) drainMillCh() {
 
 func (me *Logger) millRun() {
 	defer me.millWG.Done()
+	isLowPriority := false
 	for {
-		_, ok := <-me.millCh
+		wait := me.millWait()
+		var scanTimer *time.Timer
+		var scanCh <-chan time.Time
+		if wait > 0 {
+			scanTimer = time.NewTimer(wait)
+			scanCh = scanTimer.C
+		}
+
+		ok := true
+		select {
+		case _, ok = <-me.millCh:
+		case <-scanCh:
+		}
+		if scanTimer != nil {
+			scanTimer.Stop()
+		}
 		if !ok {
 			// millCh is closed.  Time to shut down.
+			// A pending coalesced archive is compressed first.
+			if me.CoalesceBackups {
+				me.isMillStopping = true
+				if err := me.millRunOnce(); err != nil && !errors.Is(err, errMillAbandoned) {
+					me.reportError("millRunOnce", err)
+				}
+			}
 			break
 		}
 		me.drainMillCh()
 
-		if err := me.millRunOnce(); err != nil {
-			fmt.Fprintln(os.Stderr, "error in tumble/millRunOnce:", err)
+		// The thread is never unlocked, so it exits along with the mill
+		// rather than going back to the runtime with a lowered priority.
+		if me.LowPriorityMill && !isLowPriority {
+			runtime.LockOSThread()
+			if err := setLowPriorityFn(); err != nil {
+				me.reportError("millRun", err)
+			}
+			isLowPriority = true
+		}
+
+		if me.MaxActiveAge > 0 {
+			me.rotateIfTooOld()
+		}
+
+		start := time.Now()
+		if err := me.millRunOnce(); err != nil && !errors.Is(err, errMillAbandoned) {
+			me.reportError("millRunOnce", err)
+		}
+		me.observeMillDuration(time.Since(start))
+	}
+}
+
+// millWait returns how long the mill waits to run again if not triggered,
+// or 0 to wait until triggered.
+//
+// With a RetentionScanInterval, we also wake up periodically so that
+// retention is enforced even when nothing is being written. Deferred
+// compression is retried sooner, and delayed compression once it's due.
+// Likewise for rotating the logfile once it's older than MaxActiveAge.
+func (me *Logger) millWait() time.Duration {
+	wait := me.RetentionScanInterval
+	atMost := func(d time.Duration) {
+		if d < millDeferRetry {
+			d = millDeferRetry
+		}
+		if wait <= 0 || d < wait {
+			wait = d
+		}
+	}
+	if me.isMillDeferred {
+		atMost(millDeferRetry)
+	}
+	if !me.compressDue.IsZero() {
+		atMost(me.compressDue.Sub(nowFn()))
+	}
+	if me.MaxActiveAge > 0 {
+		me.mu.Lock()
+		left, ok := me.activeAgeLeft()
+		me.mu.Unlock()
+		if !ok {
+			left = me.MaxActiveAge
 		}
+		atMost(left)
 	}
+	return wait
+}
+
+// startMill starts the mill goroutine. It is called lazily by mill(),
+// so that options set after NewLogger (such as Synchronous) are honored.
+func (me *Logger) startMill() {
+	me.startMillOnce.Do(func() {
+		if me.millCh == nil {
+			me.millCh = make(chan struct{}, 2)
+		}
+		me.millWG.Add(1)
+		go me.millRun()
+	})
 }
 
 func (me *Logger) mill() {
+	if me.Synchronous {
+		if err := me.millRunOnce(); err != nil {
+			me.reportError("millRunOnce", err)
+		}
+		return
+	}
+	me.millChMu.Lock()
+	defer me.millChMu.Unlock()
+	// Once the mill is stopped, archives rotated afterwards (e.g. by writing
+	// after Close) are left for the next Logger to compress
+	if me.isMillStopped {
+		return
+	}
+	me.startMill()
 	select {
 	case me.millCh <- struct{}{}:
 	default:
 	}
 }
 
+// StopMill stops the mill, waiting for any compression in progress to
+// finish. It is called by Close.
 func (me *Logger) StopMill() {
+	me.Shutdown(context.Background())
+}
+
+// Shutdown is like StopMill, but only waits for the mill to finish until ctx
+// is done, in which case ctx.Err() is returned. Unlike with CloseContext,
+// any compression in progress is left to finish in the background.
+func (me *Logger) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		me.stopMill()
+		me.millWG.Wait()
+		me.closeErrors()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopMill tells the mill (and the flusher) to stop, once.
+func (me *Logger) stopMill() {
 	me.stopMillOnce.Do(func() {
-		close(me.millCh)
+		me.millChMu.Lock()
+		me.isMillStopped = true
+		// Make sure a mill that was never started can't be started later
+		me.startMillOnce.Do(func() {})
+		if me.millCh != nil {
+			close(me.millCh)
+		}
+		me.millChMu.Unlock()
+		// Likewise for the flusher
+		me.flushOnce.Do(func() {})
+		if me.flushStop != nil {
+			close(me.flushStop)
+		}
+		if me.Synchronous && me.CoalesceBackups {
+			me.isMillStopping = true
+			if err := me.millRunOnce(); err != nil {
+				me.reportError("millRunOnce", err)
+			}
+		}
 	})
-	me.millWG.Wait()
 }
@@ -1,10 +1,10 @@
 package tumble
 
 import (
-	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -16,7 +16,7 @@ import (
 
 type Timestamp = int64
 
-const BIG_TIMESTAMP = Timestamp(999999999999)
+const BIG_TIMESTAMP = Timestamp(math.MaxInt64)
 const SLEEP_TIME = 100 * time.Millisecond
 
 // Ensure we always implement io.ReadCloser
@@ -24,10 +24,15 @@ var _ io.ReadCloser = (*Muster)(nil)
 
 func NewMuster(fpath string) *Muster {
 	muster := &Muster{
-		/* Filepath: */ filepath.Clean(fpath),
-
-		/* latestTs           */ Timestamp(0),
-		/* unreadyTs          */ BIG_TIMESTAMP,
+		/* Filepath:            */ filepath.Clean(fpath),
+		/* Decrypter:           */ nil,
+		/* TimestampResolution: */ ResolutionSecond,
+		/* TimestampFormat:     */ "",
+		/* LocalTime:           */ false,
+		/* Compression:         */ nil,
+
+		/* latestKey          */ archiveKey{0, 0},
+		/* unreadyKey         */ archiveKey{BIG_TIMESTAMP, 0},
 		/* openArchives       */ nil,
 		/* archiveMultireader */ nil,
 		/* lastOpenFile       */ nil,
@@ -57,8 +62,36 @@ func (me *Muster) nameExt() string {
 	return filepath.Ext(me.Filepath)
 }
 
+// This is the layout of the timestamps in archive names
+func (me *Muster) layout() timestampLayout {
+	if me.LocalTime {
+		return timestampLayout{me.TimestampResolution, me.TimestampFormat, time.Local}
+	}
+	return timestampLayout{me.TimestampResolution, me.TimestampFormat, time.UTC}
+}
+
+// This is the Compression of the archives (Gzip by default)
+func (me *Muster) compression() Compression {
+	if me.Compression == nil {
+		return Gzip{}
+	}
+	return me.Compression
+}
+
+// This is ".gz" (or ".gz.aes" for encrypted archives) in "/path/to/foo-1500000000.log.gz"
+func (me *Muster) archiveSuffix() string {
+	if me.Decrypter != nil {
+		return me.compression().Extension() + me.Decrypter.Suffix()
+	}
+	return me.compression().Extension()
+}
+
 func (me *Muster) timestampToFpath(ts Timestamp) string {
-	return fmt.Sprintf("%s%s-%d%s%s", me.dirpath(), me.namePrefix(), ts, me.nameExt(), compressSuffix)
+	if layout := me.layout(); !layout.isUnixSeconds() {
+		name := layout.formatTime(layout.fromKey(ts))
+		return fmt.Sprintf("%s%s-%s%s%s", me.dirpath(), me.namePrefix(), name, me.nameExt(), me.archiveSuffix())
+	}
+	return fmt.Sprintf("%s%s-%d%s%s", me.dirpath(), me.namePrefix(), ts, me.nameExt(), me.archiveSuffix())
 }
 
 func (me *Muster) timestampLength() int {
@@ -67,6 +100,14 @@ func (me *Muster) timestampLength() int {
 }
 
 func (me *Muster) parseTimestamp(s string) (Timestamp, error) {
+	if layout := me.layout(); !layout.isUnixSeconds() {
+		t, err := layout.parse(s)
+		if err != nil {
+			return 0, err
+		}
+		return layout.key(t), nil
+	}
+
 	if len(s) != me.timestampLength() {
 		return 0, errors.New("invalid timestamp")
 	}
@@ -84,12 +125,14 @@ func (me *Muster) fpathToTimestamp(fpath string) (Timestamp, error) {
 	namePrefix := me.namePrefix()
 	nameExt := me.nameExt()
 
-	// fpath must be exactly this long to possibly match
-	if len(fpath) != len(dirpath)+len(namePrefix)+len("-")+me.timestampLength()+len(nameExt)+len(compressSuffix) {
+	// fpath must be exactly this long to possibly match (or, for the other
+	// resolutions, at least long enough)
+	minLen := len(dirpath) + len(namePrefix) + len("-") + len(nameExt) + len(me.archiveSuffix())
+	if me.layout().isUnixSeconds() && len(fpath) != minLen+me.timestampLength() || len(fpath) <= minLen {
 		return 0, errors.New("mismatch")
 	}
 
-	middle := fpath[len(dirpath)+len(namePrefix) : len(fpath)-len(nameExt)-len(compressSuffix)]
+	middle := fpath[len(dirpath)+len(namePrefix) : len(fpath)-len(nameExt)-len(me.archiveSuffix())]
 
 	// middle should be a hyphen followed by a timestamp
 	if !strings.HasPrefix(middle, "-") {
@@ -110,6 +153,53 @@ func (me *Muster) fpathToTimestamp(fpath string) (Timestamp, error) {
 	return ts, nil
 }
 
+// archiveKey orders archives by the timestamp in their name, then by the
+// counter appended to names which would otherwise be the same
+// (e.g. "foo-1500000000.1.log.gz").
+type archiveKey struct {
+	ts      Timestamp
+	counter int64
+}
+
+func (me archiveKey) less(other archiveKey) bool {
+	return me.ts < other.ts || me.ts == other.ts && me.counter < other.counter
+}
+
+func (me *Muster) keyToFpath(key archiveKey) string {
+	fpath := me.timestampToFpath(key.ts)
+	if key.counter == 0 {
+		return fpath
+	}
+	suffix := me.nameExt() + me.archiveSuffix()
+	return fmt.Sprintf("%s.%d%s", fpath[:len(fpath)-len(suffix)], key.counter, suffix)
+}
+
+func (me *Muster) fpathToKey(fpath string) (archiveKey, error) {
+	if ts, err := me.fpathToTimestamp(fpath); err == nil {
+		return archiveKey{ts, 0}, nil
+	}
+
+	// A counter may have been appended to the timestamp
+	suffix := me.nameExt() + me.archiveSuffix()
+	if !strings.HasSuffix(fpath, suffix) {
+		return archiveKey{}, errors.New("mismatch")
+	}
+	name := fpath[:len(fpath)-len(suffix)]
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return archiveKey{}, errors.New("mismatch")
+	}
+	counter, err := strconv.ParseInt(name[i+1:], 10, 64)
+	if err != nil || counter <= 0 || counter >= maxCounter {
+		return archiveKey{}, errors.New("mismatch")
+	}
+	ts, err := me.fpathToTimestamp(name[:i] + suffix)
+	if err != nil {
+		return archiveKey{}, errors.New("mismatch")
+	}
+	return archiveKey{ts, counter}, nil
+}
+
 func getOpenFilesLimit() uint64 {
 	var rlimit syscall.Rlimit
 	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
@@ -119,74 +209,77 @@ func getOpenFilesLimit() uint64 {
 	return rlimit.Cur
 }
 
-func (me *Muster) getNewTimestamps() ([]Timestamp, error) {
+func (me *Muster) getNewTimestamps() ([]archiveKey, error) {
 	files, err := os.ReadDir(filepath.Dir(me.Filepath))
 	if err != nil {
 		return nil, fmt.Errorf("error listing timestamps: %w", err)
 	}
 
 	// Reset the unready timestamp each time
-	me.unreadyTs = BIG_TIMESTAMP
+	me.unreadyKey = archiveKey{BIG_TIMESTAMP, 0}
 
-	// potentialTimestamps are archive timestamps greater than me.latestTs
+	// potentialKeys are archive keys greater than me.latestKey
 	dirpath := me.dirpath()
-	potentialTimestamps := []Timestamp{}
+	potentialKeys := []archiveKey{}
 	for _, f := range files {
-		// Check for a currently-compressing file.
-		ts, err := me.fpathToTimestamp(dirpath + f.Name() + compressSuffix)
-		if err == nil {
-			if ts < me.unreadyTs {
-				me.unreadyTs = ts
+		// Check for a currently-compressing file (unless archives aren't
+		// compressed at all).
+		if me.archiveSuffix() != "" {
+			key, err := me.fpathToKey(dirpath + f.Name() + me.archiveSuffix())
+			if err == nil {
+				if key.less(me.unreadyKey) {
+					me.unreadyKey = key
+				}
+				continue
 			}
-			continue
 		}
 
 		// Check for a compressed archive
-		ts, err = me.fpathToTimestamp(dirpath + f.Name())
+		key, err := me.fpathToKey(dirpath + f.Name())
 		if err != nil {
 			continue
 		}
 
-		// Add any timestamp greater than the latest one.
+		// Add any key greater than the latest one.
 		// We will filter unready ones later once we know the unready ceiling.
-		if ts > me.latestTs {
-			potentialTimestamps = append(potentialTimestamps, ts)
+		if me.latestKey.less(key) {
+			potentialKeys = append(potentialKeys, key)
 		}
 	}
 
-	// Reduce to ready timestamps
-	readyTimestamps := make([]Timestamp, 0, len(potentialTimestamps))
-	for _, ts := range potentialTimestamps {
-		if ts < me.unreadyTs {
-			readyTimestamps = append(readyTimestamps, ts)
+	// Reduce to ready keys
+	readyKeys := make([]archiveKey, 0, len(potentialKeys))
+	for _, key := range potentialKeys {
+		if key.less(me.unreadyKey) {
+			readyKeys = append(readyKeys, key)
 		}
 	}
 
-	// Sort ready timestamps in descending order, limited to MaxArchiveLookback()
-	sort.Slice(readyTimestamps, func(i, j int) bool { return readyTimestamps[i] > readyTimestamps[j] })
-	if len(readyTimestamps) > me.MaxArchiveLookback() {
-		readyTimestamps = readyTimestamps[:me.MaxArchiveLookback()]
+	// Sort ready keys in descending order, limited to MaxArchiveLookback()
+	sort.Slice(readyKeys, func(i, j int) bool { return readyKeys[j].less(readyKeys[i]) })
+	if len(readyKeys) > me.MaxArchiveLookback() {
+		readyKeys = readyKeys[:me.MaxArchiveLookback()]
 	}
 
-	if len(readyTimestamps) > 0 {
-		me.latestTs = readyTimestamps[0]
+	if len(readyKeys) > 0 {
+		me.latestKey = readyKeys[0]
 	}
-	return readyTimestamps, nil
+	return readyKeys, nil
 }
 
 func (me *Muster) loadArchives() error {
-	timestamps, err := me.getNewTimestamps()
+	keys, err := me.getNewTimestamps()
 	if err != nil {
 		return fmt.Errorf("error processing archives: %w", err)
 	}
 
 	// Open all the files in one go from newest to oldest, stopping at
 	// a NotExist error (the file was probably deleted by rotation).
-	me.openArchives = make([]io.Closer, 0, len(timestamps))
-	readers := make([]io.Reader, 0, len(timestamps))
-	for _, ts := range timestamps {
+	me.openArchives = make([]io.Closer, 0, len(keys))
+	readers := make([]io.Reader, 0, len(keys))
+	for _, key := range keys {
 		// Open the file, adding it to me.openArchives
-		fpath := me.timestampToFpath(ts)
+		fpath := me.keyToFpath(key)
 		f, err := os.Open(fpath)
 		if err != nil {
 			if errors.Is(err, os.ErrNotExist) {
@@ -197,13 +290,22 @@ func (me *Muster) loadArchives() error {
 		}
 		me.openArchives = append(me.openArchives, f)
 
+		// Encrypted archives are decrypted before decompression
+		var r io.Reader = f
+		if me.Decrypter != nil {
+			r, err = me.Decrypter.NewReader(f)
+			if err != nil {
+				return fmt.Errorf("error creating decryption reader for %s: %w", fpath, err)
+			}
+		}
+
 		// Create a decompression reader to be used in a MultiReader below
-		gzReader, err := gzip.NewReader(f)
+		dr, err := newDecompressReader(r, me.compression().Extension(), me.compression())
 		if err != nil {
 			f.Close()
 			return fmt.Errorf("error creating decompression reader for %s: %w", fpath, err)
 		}
-		readers = append(readers, gzReader)
+		readers = append(readers, dr)
 	}
 
 	if len(readers) > 0 {
@@ -278,7 +380,7 @@ func (me *Muster) Read(p []byte) (int, error) {
 		// When we make it to here, we have processed all ready archives,
 		// but there could still be an unready archive. In that case,
 		// we must wait for everything to be ready before proceeding.
-		if me.unreadyTs < BIG_TIMESTAMP {
+		if me.unreadyKey.ts < BIG_TIMESTAMP {
 			time.Sleep(SLEEP_TIME)
 			continue
 		}
@@ -296,7 +398,7 @@ func (me *Muster) Read(p []byte) (int, error) {
 				if me.archiveMultireader != nil {
 					continue
 				}
-				if me.unreadyTs < BIG_TIMESTAMP {
+				if me.unreadyKey.ts < BIG_TIMESTAMP {
 					time.Sleep(SLEEP_TIME)
 					continue
 				}
@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package tumble
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// O_DIRECT needs aligned writes, which we can't provide
+const directFlag = syscall.O_DIRECT
+
+// See fallocate(2)
+const fallocKeepSize = 0x01
+
+const (
+	millNiceness = 10
+
+	// See ioprio_set(2): best-effort class, lowest priority
+	ioprioWhoProcess = 1
+	ioprioClassBE    = 2
+	ioprioClassShift = 13
+	ioprioLowestBE   = ioprioClassBE<<ioprioClassShift | 7
+)
+
+// setLowPriority lowers the CPU and I/O scheduling priority of the calling
+// thread. The caller must have locked the goroutine to its OS thread.
+func setLowPriority() error {
+	tid := syscall.Gettid()
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, millNiceness); err != nil {
+		return fmt.Errorf("can't set mill priority: %s", err)
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioLowestBE)
+	if errno != 0 {
+		return fmt.Errorf("can't set mill io priority: %s", errno)
+	}
+	return nil
+}
+
+// preallocate reserves disk space for size bytes of f without changing
+// its apparent size.
+func preallocate(f *os.File, size int64) error {
+	if err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size); err != nil {
+		return fmt.Errorf("can't preallocate log file: %s", err)
+	}
+	return nil
+}
+
+// freeInodes returns the number of free inodes on the filesystem of dir.
+func freeInodes(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("can't get filesystem info: %s", err)
+	}
+	return stat.Ffree, nil
+}
+
+// freeBytes returns the disk space (in bytes) available to unprivileged
+// users on the filesystem of dir.
+func freeBytes(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("can't get filesystem info: %s", err)
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package tumble
+
+import (
+	"math"
+	"os"
+)
+
+const directFlag = 0
+
+// setLowPriority is a no-op outside of Linux.
+func setLowPriority() error {
+	return nil
+}
+
+// preallocate is a no-op outside of Linux.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
+
+// freeInodes is unlimited outside of Linux.
+func freeInodes(dir string) (uint64, error) {
+	return math.MaxUint64, nil
+}
+
+// freeBytes is unlimited outside of Linux.
+func freeBytes(dir string) (uint64, error) {
+	return math.MaxUint64, nil
+}
@@ -0,0 +1,85 @@
+package tumble
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const corruptSuffix = ".corrupt"
+
+// repair reconciles the archives in the log directory after a crash or manual
+// meddling. Each anomaly that is handled is reported via reportError:
+//
+//   - Uncompressed archives are compressed, replacing any partial archive.
+//   - Compressed archives that can't be decompressed are renamed with a
+//     ".corrupt" suffix, so that they are kept but no longer used.
+//   - Temporary files left by an interrupted compression are removed.
+//   - Files that look like ours but whose names don't parse are left alone.
+//
+func (me *Logger) repair() error {
+	me.millMu.Lock()
+	defer me.millMu.Unlock()
+
+	files, err := ioutil.ReadDir(me.dir())
+	if err != nil {
+		return fmt.Errorf("can't read log file directory: %s", err)
+	}
+	prefix, ext := me.prefixAndExt()
+
+	compressed := []string{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		fpath := filepath.Join(me.dir(), name)
+		if me.archiveSuffix() != "" && strings.HasSuffix(name, me.archiveSuffix()+compressTmpSuffix) {
+			if err := os.Remove(fpath); err != nil {
+				return fmt.Errorf("can't remove partial archive: %s", err)
+			}
+			me.reportError("repair", fmt.Errorf("removed partial archive %s", name))
+			continue
+		}
+		if _, err := me.timeFromName(name, prefix, ext+me.archiveExt(name)); err != nil {
+			me.reportError("repair", fmt.Errorf("unrecognized file %s", name))
+			continue
+		}
+		if !me.isCompressed(name) {
+			if err := me.compressLogFile(fpath); err != nil {
+				return err
+			}
+			me.reportError("repair", fmt.Errorf("compressed uncompressed archive %s", name))
+			continue
+		}
+		compressed = append(compressed, fpath)
+	}
+
+	// Anything that was just compressed above is already known to be good,
+	// but it's cheap enough to check everything. Encrypted archives can only
+	// be checked if the Encrypter is also a Decrypter (and likewise for
+	// Compression and Decompressor).
+	for _, fpath := range compressed {
+		if err := me.verifyBackup(fpath); err != nil && err != errNoDecrypter && err != errNoDecompressor {
+			if err := os.Rename(fpath, fpath+corruptSuffix); err != nil {
+				return fmt.Errorf("can't rename corrupt archive: %s", err)
+			}
+			me.reportError("repair", fmt.Errorf("renamed corrupt archive %s: %v", filepath.Base(fpath), err))
+		}
+	}
+	return nil
+}
+
+// verifyBackup reads the given compressed archive in full to check its integrity.
+func (me *Logger) verifyBackup(fpath string) error {
+	r, err := me.openBackup(fpath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
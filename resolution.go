@@ -0,0 +1,219 @@
+package tumble
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimestampResolution determines the layout and resolution of the time in
+// archive names. Archives that would get the same name (e.g. two rotations
+// on the same day with ResolutionDay) get a counter, so they stay in order.
+type TimestampResolution int
+
+const (
+	// ResolutionSecond names archives by unix time in seconds
+	// (e.g. "foo-1500000000.log").
+	ResolutionSecond TimestampResolution = iota
+
+	// ResolutionDay names archives by date (e.g. "foo-2017-07-14.log"), in
+	// UTC unless LocalTime is set.
+	// Later archives of the same day get a counter
+	// (e.g. "foo-2017-07-14.1.log").
+	ResolutionDay
+
+	// ResolutionMillisecond names archives by unix time in milliseconds
+	// (e.g. "foo-1500000000123.log").
+	ResolutionMillisecond
+
+	// ResolutionNanosecond names archives by unix time in nanoseconds
+	// (e.g. "foo-1500000000123456789.log").
+	ResolutionNanosecond
+)
+
+const (
+	dayLayout  = "2006-01-02"
+	day        = 24 * time.Hour
+	maxCounter = 1000000
+)
+
+// Within a day, the counter of a name is kept in the nanoseconds of its
+// time, so that names sort by time. Days are in loc (UTC, unless LocalTime).
+
+// startOfDay returns the midnight (in loc) starting the day of t.
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// truncate returns the time in the name of an archive made at t.
+func (me TimestampResolution) truncate(t time.Time, loc *time.Location) time.Time {
+	switch me {
+	case ResolutionDay:
+		return startOfDay(t, loc)
+	case ResolutionMillisecond:
+		return t.UTC().Truncate(time.Millisecond)
+	case ResolutionNanosecond:
+		return t.UTC()
+	default:
+		return t.UTC().Truncate(time.Second)
+	}
+}
+
+func (me TimestampResolution) format(t time.Time, loc *time.Location) string {
+	switch me {
+	case ResolutionDay:
+		date := startOfDay(t, loc)
+		if counter := t.Sub(date); counter > 0 {
+			return fmt.Sprintf("%s.%d", date.Format(dayLayout), counter)
+		}
+		return date.Format(dayLayout)
+	case ResolutionMillisecond:
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	case ResolutionNanosecond:
+		return strconv.FormatInt(t.UnixNano(), 10)
+	default:
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+}
+
+func (me TimestampResolution) parse(s string, loc *time.Location) (time.Time, error) {
+	if me == ResolutionDay {
+		var counter int64
+		if i := strings.IndexByte(s, '.'); i >= 0 {
+			n, err := strconv.ParseInt(s[i+1:], 10, 64)
+			if err != nil || n <= 0 || n >= maxCounter {
+				return time.Time{}, errors.New("invalid timestamp")
+			}
+			s, counter = s[:i], n
+		}
+		date, err := time.ParseInLocation(dayLayout, s, loc)
+		if err != nil {
+			return time.Time{}, errors.New("invalid timestamp")
+		}
+		return date.Add(time.Duration(counter)), nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("invalid timestamp")
+	}
+	switch me {
+	case ResolutionMillisecond:
+		return time.Unix(0, n*int64(time.Millisecond)).UTC(), nil
+	case ResolutionNanosecond:
+		return time.Unix(0, n).UTC(), nil
+	default:
+		return time.Unix(n, 0).UTC(), nil
+	}
+}
+
+// key returns the Muster timestamp of a name time. Keys sort like the times.
+func (me TimestampResolution) key(t time.Time, loc *time.Location) Timestamp {
+	switch me {
+	case ResolutionDay:
+		date := startOfDay(t, loc)
+		days := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC).Unix() / int64(day/time.Second)
+		return days*maxCounter + int64(t.Sub(date))
+	case ResolutionMillisecond:
+		return t.UnixNano() / int64(time.Millisecond)
+	case ResolutionNanosecond:
+		return t.UnixNano()
+	default:
+		return t.Unix()
+	}
+}
+
+// fromKey is the inverse of key.
+func (me TimestampResolution) fromKey(ts Timestamp, loc *time.Location) time.Time {
+	switch me {
+	case ResolutionDay:
+		year, month, mday := time.Unix(ts/maxCounter*int64(day/time.Second), 0).UTC().Date()
+		return time.Date(year, month, mday, 0, 0, 0, int(ts%maxCounter), loc)
+	case ResolutionMillisecond:
+		return time.Unix(0, ts*int64(time.Millisecond)).UTC()
+	case ResolutionNanosecond:
+		return time.Unix(0, ts).UTC()
+	default:
+		return time.Unix(ts, 0).UTC()
+	}
+}
+
+// timestampLayout is the layout of the time in archive names: either
+// TimestampFormat, if set, or TimestampResolution. Times are formatted in
+// loc, which is UTC unless LocalTime is set.
+type timestampLayout struct {
+	resolution TimestampResolution
+	format     string
+	loc        *time.Location
+}
+
+// isUnixSeconds tells whether this is the default layout.
+func (me timestampLayout) isUnixSeconds() bool {
+	return me.format == "" && me.resolution == ResolutionSecond
+}
+
+// validate rejects formats which would be mistaken for another directory
+// or for part of the extension.
+func (me timestampLayout) validate() error {
+	if strings.ContainsAny(me.format, `/\.`) {
+		return fmt.Errorf("invalid TimestampFormat %q: path separators and '.' are not allowed", me.format)
+	}
+	return nil
+}
+
+func (me timestampLayout) truncate(t time.Time) time.Time {
+	if me.format == "" {
+		return me.resolution.truncate(t, me.loc)
+	}
+	if truncated, err := me.parse(me.formatTime(t)); err == nil {
+		return truncated
+	}
+	return t
+}
+
+func (me timestampLayout) formatTime(t time.Time) string {
+	if me.format == "" {
+		return me.resolution.format(t, me.loc)
+	}
+	return t.In(me.loc).Format(me.format)
+}
+
+// formatName returns the time in the name of an archive with the name time t.
+// Archives which would get the same name have a counter in the nanoseconds of
+// their time, which is appended (e.g. "2017-07-14T10-00-00.1"), so that names
+// sort by time. See Logger.freeBackupName.
+func (me timestampLayout) formatName(t time.Time) string {
+	base := me.truncate(t)
+	if counter := t.Sub(base); counter > 0 {
+		return fmt.Sprintf("%s.%d", me.formatTime(base), counter)
+	}
+	return me.formatTime(t)
+}
+
+func (me timestampLayout) parse(s string) (time.Time, error) {
+	if me.format == "" {
+		return me.resolution.parse(s, me.loc)
+	}
+	t, err := time.ParseInLocation(me.format, s, me.loc)
+	if err != nil || t.Format(me.format) != s {
+		return time.Time{}, errors.New("invalid timestamp")
+	}
+	return t, nil
+}
+
+func (me timestampLayout) key(t time.Time) Timestamp {
+	if me.format == "" {
+		return me.resolution.key(t, me.loc)
+	}
+	return t.UnixNano()
+}
+
+func (me timestampLayout) fromKey(ts Timestamp) time.Time {
+	if me.format == "" {
+		return me.resolution.fromKey(ts, me.loc)
+	}
+	return time.Unix(0, ts).UTC()
+}
@@ -1,46 +1,342 @@
 package tumble
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"syscall"
+	"time"
 )
 
-func backupName(fpath string) string {
+// ErrReadOnlyDir is returned when the logfile can't be created or rotated
+// because the log directory is on a read-only filesystem.
+var ErrReadOnlyDir = errors.New("log directory is read-only")
+
+// readOnlyDirError wraps err with ErrReadOnlyDir if it's due to a read-only
+// filesystem, so that this common misconfiguration is easy to tell apart.
+func readOnlyDirError(err error) error {
+	if errors.Is(err, syscall.EROFS) {
+		return fmt.Errorf("%w: %s", ErrReadOnlyDir, err)
+	}
+	return err
+}
+
+func backupName(fpath, ts string) string {
 	dir := filepath.Dir(fpath)
 	filename := filepath.Base(fpath)
 	ext := filepath.Ext(filename)
 	prefix := filename[:len(filename)-len(ext)]
-	t := nowFn().UTC()
-	return filepath.Join(dir, fmt.Sprintf("%s-%d%s", prefix, t.Unix(), ext))
+	return filepath.Join(dir, fmt.Sprintf("%s-%s%s", prefix, ts, ext))
+}
+
+// freeBackupName returns the archive name for the logfile at fpath with the
+// time t, and the time in that name. If that archive exists already (e.g.
+// BackupTimeFn gave the same time twice), the counter appended to the time is
+// increased until the name is free, e.g. "foo-1500000000.1.log".
+// With SubdirLayout, the archive is in a subdirectory.
+func (me *Logger) freeBackupName(fpath string, t time.Time) (string, time.Time) {
+	fpath = filepath.Join(me.backupDir(filepath.Dir(fpath), t), filepath.Base(fpath))
+	newname := backupName(fpath, me.layout().formatName(t))
+	for me.backupExists(newname) {
+		t = t.Add(time.Nanosecond)
+		newname = backupName(fpath, me.layout().formatName(t))
+	}
+	return newname, t
+}
+
+// backupExists tells whether the archive at fpath exists, compressed or not.
+func (me *Logger) backupExists(fpath string) bool {
+	for _, name := range []string{fpath, fpath + compressSuffix, fpath + me.archiveSuffix()} {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRecordScan is how much of the logfile is read to find its first and
+// last records for BackupTimeFn.
+const maxRecordScan = 64 * 1024
+
+// ClockSkewPolicy determines what happens on rotation when the clock is not
+// later than the time in the name of the newest archive (e.g. it went
+// backwards after an NTP correction). Without one, archives could end up
+// out of order.
+type ClockSkewPolicy int
+
+const (
+	// SkewBumpName names the new archive just after the newest one: with
+	// the same time, and the next counter (e.g. "foo-1500000000.1.log").
+	// Rotations within the same second are always named this way.
+	SkewBumpName ClockSkewPolicy = iota
+
+	// SkewDeferRotation keeps appending to the logfile until the clock
+	// is later than the newest archive (when the logfile is already open).
+	SkewDeferRotation
+)
+
+// backupTime is the time in the archive name of the logfile at fpath. It is
+// the current time, unless BackupTimeFn derives it from the logfile content.
+func (me *Logger) backupTime(fpath string) time.Time {
+	if me.BackupTimeFn != nil {
+		first, last, err := firstAndLastRecords(fpath)
+		if err != nil {
+			me.reportError("openNew", err)
+		} else if t := me.BackupTimeFn(first, last); !t.IsZero() {
+			return me.layout().truncate(t)
+		}
+	}
+
+	// Archive names follow the clock, but never go backwards: otherwise, the
+	// archive gets the time of the newest one, and a counter after it (see
+	// freeBackupName)
+	t := me.layout().truncate(nowFn())
+	if newest := me.newestBackupTime(); !t.After(newest) {
+		t = newest
+	}
+	return t
+}
+
+// newestBackupTime returns the time in the name of the newest archive, which
+// is looked up on first use, or the zero time if there are none.
+func (me *Logger) newestBackupTime() time.Time {
+	if me.lastBackupTime.IsZero() {
+		if oldFiles, err := me.oldLogFiles(); err == nil && len(oldFiles) > 0 {
+			me.lastBackupTime = oldFiles[0].timestamp
+		}
+	}
+	return me.lastBackupTime
+}
+
+// isClockSkewed tells whether rotation should be deferred per ClockSkew.
+func (me *Logger) isClockSkewed() bool {
+	return me.ClockSkew == SkewDeferRotation && me.BackupTimeFn == nil &&
+		nowFn().Before(me.newestBackupTime())
+}
+
+// firstAndLastRecords returns the first and last lines (without the newline)
+// of the file at fpath. Lines longer than maxRecordScan are cut short.
+func firstAndLastRecords(fpath string) (first, last []byte, err error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't open log file: %s", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, maxRecordScan)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, nil, fmt.Errorf("can't read log file: %s", err)
+	}
+	first = buf[:n]
+	if i := bytes.IndexByte(first, '\n'); i >= 0 {
+		first = first[:i]
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't read log file: %s", err)
+	}
+	offset := size - maxRecordScan
+	if offset < 0 {
+		offset = 0
+	}
+	buf = make([]byte, size-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("can't read log file: %s", err)
+	}
+	last = bytes.TrimSuffix(buf, []byte("\n"))
+	if i := bytes.LastIndexByte(last, '\n'); i >= 0 {
+		last = last[i+1:]
+	}
+	return first, last, nil
 }
 
 func (me *Logger) openNew() error {
-	name := me.Filepath
-	_, err := os.Stat(name)
+	if me.MinFreeInodes > 0 {
+		me.ensureFreeInodes()
+	}
+
+	name := me.fpath()
+	backup := ""
+	info, err := os.Stat(name)
 	if err == nil {
-		newname := backupName(name)
-		if err := os.Rename(name, newname); err != nil {
-			return fmt.Errorf("can't rename log file: %s", err)
+		if me.PreviousName != "" {
+			if err := me.linkPrevious(name); err != nil {
+				me.reportError("openNew", err)
+			}
+		}
+		newname, t := me.freeBackupName(name, me.backupTime(name))
+		if me.SubdirLayout != "" {
+			if err := os.MkdirAll(filepath.Dir(newname), me.dirMode()); err != nil {
+				return fmt.Errorf("can't make archive directory: %s", err)
+			}
+		}
+		if err := renameFn(name, newname); err != nil {
+			if !errors.Is(err, errSharingViolation) {
+				return fmt.Errorf("can't rename log file: %w", readOnlyDirError(err))
+			}
+			// A reader is holding the logfile (on Windows), so we fall back to
+			// copytruncate for this rotation. The logfile is truncated below.
+			if err := copyFile(name, newname, me.fileMode()); err != nil {
+				return fmt.Errorf("can't copy log file: %s", err)
+			}
+			me.reportError("openNew", fmt.Errorf("log file is in use, copied it instead of renaming: %w", err))
+		}
+		backup = newname
+		if t.After(me.newestBackupTime()) {
+			me.lastBackupTime = t
+		}
+		if me.archiveSuffix() == "" {
+			me.addFinalized(backup)
 		}
 	}
 
-	// we use truncate here because this should only get called when we've moved
-	// the file ourselves. if someone else creates the file in the meantime,
-	// just wipe out the contents.
-	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(fileMode))
-	if err != nil {
-		return fmt.Errorf("can't open new logfile: %s", err)
+	if err := os.MkdirAll(filepath.Dir(name), me.dirMode()); err != nil {
+		return fmt.Errorf("can't make directories for new logfile: %s", err)
+	}
+	var f *os.File
+	if me.WarmStandby {
+		f = me.takeStandby(name)
+		me.prepareStandby()
+	}
+	if f == nil {
+		// we use truncate here because this should only get called when we've moved
+		// the file ourselves. if someone else creates the file in the meantime,
+		// just wipe out the contents.
+		f, err = openFileFn(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|me.OpenFlags, me.fileMode())
+		if err != nil {
+			return fmt.Errorf("can't open new logfile: %w", readOnlyDirError(err))
+		}
 	}
-	me.file = f
+	if me.PreallocateActive {
+		if err := preallocateFn(f, me.maxLogSize()); err != nil {
+			me.reportError("openNew", err)
+		}
+	}
+	me.file = me.bufferFile(f)
 	me.size = 0
+	me.openedAt = nowFn()
+	prevStart := me.fileStart
+	me.fileStart = time.Time{}
+	me.headerSize = 0
+	if me.Symlink != "" {
+		if err := me.updateSymlink(); err != nil {
+			return err
+		}
+	}
+	if me.Header != nil {
+		if err := me.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	if me.OnRotatePaths != nil && backup != "" {
+		me.OnRotatePaths(backup, name)
+	}
+	if me.OnRotate != nil && backup != "" {
+		go me.OnRotate(name, backup)
+	}
+	if me.RotationSummary && backup != "" {
+		return me.writeSummary(backup, info.Size(), prevStart)
+	}
+	return nil
+}
+
+// writeHeader writes the Header at the top of a new logfile.
+func (me *Logger) writeHeader() error {
+	n, err := me.file.Write(me.Header())
+	me.size += int64(n)
+	me.headerSize = me.size
+	if err != nil {
+		return fmt.Errorf("can't write header: %s", err)
+	}
 	return nil
 }
 
+// writeSummary writes a line at the top of a new logfile describing the
+// logfile that was just rotated. The duration is only known if the previous
+// logfile was written to by us. Like the header, the summary alone doesn't
+// make the logfile worth archiving.
+func (me *Logger) writeSummary(backup string, size int64, start time.Time) error {
+	summary := fmt.Sprintf("tumble: rotated previous logfile (%d bytes) to %s", size, filepath.Base(backup))
+	if !start.IsZero() {
+		summary += fmt.Sprintf(" after %s", nowFn().Sub(start))
+	}
+	summary += "\n"
+
+	n, err := me.file.Write([]byte(summary))
+	me.size += int64(n)
+	me.headerSize = me.size
+	if err != nil {
+		return fmt.Errorf("can't write rotation summary: %s", err)
+	}
+	return nil
+}
+
+// linkPrevious makes Filepath+PreviousName refer to the content of name.
+// This happens before name is renamed, so the mill can't race us for it.
+func (me *Logger) linkPrevious(name string) error {
+	prevname := name + me.PreviousName
+	if err := os.Remove(prevname); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("can't remove previous log file: %s", err)
+	}
+	if err := os.Link(name, prevname); err == nil {
+		return nil
+	}
+
+	// Hard links aren't always possible. Fall back to copying.
+	if err := copyFile(name, prevname, me.fileMode()); err != nil {
+		return fmt.Errorf("can't copy previous log file: %s", err)
+	}
+	return nil
+}
+
+// copyFile copies the content of src to dst, replacing dst. If dst is
+// created, it gets the given permissions.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
 func (me *Logger) openExistingOrNew(writeLen int) error {
+	if err := me.Validate(); err != nil {
+		return err
+	}
+	// Everything below expects the log directory to exist
+	if err := os.MkdirAll(me.dir(), me.dirMode()); err != nil {
+		return fmt.Errorf("can't make log directory: %w", err)
+	}
+	if me.SequenceNumbers && me.SequenceSidecar && !me.isSeqLoaded {
+		me.isSeqLoaded = true
+		if err := me.loadSeq(); err != nil {
+			return err
+		}
+	}
+	if me.RepairOnStart && !me.isRepaired {
+		me.isRepaired = true
+		if err := me.repair(); err != nil {
+			return fmt.Errorf("can't repair archives: %s", err)
+		}
+	}
 	me.mill()
 
-	fpath := me.Filepath
+	fpath := me.fpath()
 	info, err := os.Stat(fpath)
 	if os.IsNotExist(err) {
 		return me.openNew()
@@ -49,28 +345,139 @@ func (me *Logger) openExistingOrNew(writeLen int) error {
 		return fmt.Errorf("error getting log file info: %s", err)
 	}
 
-	if info.Size()+int64(writeLen) >= int64(me.MaxLogSizeMB*MB) {
+	if info.Size()+int64(writeLen) >= me.maxLogSize() {
 		return me.rotate()
 	}
+	if me.RotateOnStart && !me.isRotatedOnStart {
+		me.isRotatedOnStart = true
+		if info.Size() > 0 || me.RotateEmptyFiles {
+			return me.rotate()
+		}
+	}
 
-	file, err := os.OpenFile(fpath, os.O_APPEND|os.O_WRONLY, fileMode)
+	file, err := openFileFn(fpath, os.O_APPEND|os.O_WRONLY|me.OpenFlags, me.fileMode())
 	if err != nil {
 		// if we fail to open the old log file for some reason, just ignore
 		// it and open a new log file.
 		return me.openNew()
 	}
-	me.file = file
-	me.size = info.Size()
+
+	// Another process may have appended to the file since we called Stat,
+	// so the end offset of the opened file is the authoritative size.
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("can't get log file size: %s", err)
+	}
+	me.file = me.bufferFile(file)
+	me.size = size
+	me.openedAt = nowFn()
+	me.headerSize = 0
+	if me.Header != nil && size == 0 {
+		if err := me.writeHeader(); err != nil {
+			return err
+		}
+	}
+	if me.WarmStandby {
+		me.prepareStandby()
+	}
+	if me.Symlink != "" {
+		if err := me.updateSymlink(); err != nil {
+			return err
+		}
+	}
+	if me.MaxLogAge > 0 {
+		// The logfile was created when the newest archive was rotated, so
+		// restarts don't reset its age
+		if newest := me.newestBackupTime(); !newest.IsZero() && newest.Before(me.openedAt) {
+			me.openedAt = newest
+		}
+		if me.isPastMaxLogAge() {
+			return me.rotate()
+		}
+	}
+	return nil
+}
+
+// Rotate renames the logfile to an archive and opens a new one, e.g. before
+// taking a snapshot. It blocks until the rename is done, but not until the
+// archive is compressed (unless Synchronous is set). If no logfile is open,
+// the existing one (if any) is opened first, so an empty logfile is only
+// archived with RotateEmptyFiles.
+func (me *Logger) Rotate() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if me.file == nil {
+		if err := me.openExistingOrNew(0); err != nil {
+			return err
+		}
+	}
+	return me.rotate()
+}
+
+// Reopen closes the logfile and opens it again by name, e.g. after an
+// external tool (like logrotate without copytruncate) renamed it. If it
+// was moved away, a new logfile is created. Unlike Rotate, Reopen renames
+// nothing and leaves the mill alone.
+func (me *Logger) Reopen() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if err := me.closeFile(); err != nil {
+		return err
+	}
+
+	fpath := me.fpath()
+	if err := os.MkdirAll(filepath.Dir(fpath), me.dirMode()); err != nil {
+		return fmt.Errorf("can't make directories for logfile: %s", err)
+	}
+	f, err := openFileFn(fpath, os.O_CREATE|os.O_APPEND|os.O_WRONLY|me.OpenFlags, me.fileMode())
+	if err != nil {
+		return fmt.Errorf("can't reopen logfile: %w", readOnlyDirError(err))
+	}
+	// The path may now refer to another file, so its size starts over
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("can't get log file size: %s", err)
+	}
+	me.file = me.bufferFile(f)
+	me.size = size
+	me.openedAt = nowFn()
+	me.fileStart = time.Time{}
+	me.headerSize = 0
+	if me.Symlink != "" {
+		if err := me.updateSymlink(); err != nil {
+			return err
+		}
+	}
+	if me.Header != nil && size == 0 {
+		if err := me.writeHeader(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (me *Logger) rotate() error {
+	// An empty logfile isn't worth archiving
+	if me.file != nil && me.size == me.headerSize && !me.RotateEmptyFiles {
+		return nil
+	}
+	if me.file != nil && me.isClockSkewed() {
+		return nil
+	}
 	if err := me.closeFile(); err != nil {
 		return err
 	}
 	if err := me.openNew(); err != nil {
 		return err
 	}
+	me.rotations++
+	if me.OnRotateMetric != nil {
+		me.OnRotateMetric()
+	}
 	me.mill()
 	return nil
 }
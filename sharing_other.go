@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package tumble
+
+import "errors"
+
+// errSharingViolation is never returned outside of Windows, where an open
+// file can always be renamed.
+var errSharingViolation = errors.New("sharing violation")
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package tumble
+
+import "syscall"
+
+// errSharingViolation is ERROR_SHARING_VIOLATION, which is returned when
+// renaming a file that another process has open without FILE_SHARE_DELETE.
+const errSharingViolation = syscall.Errno(32)
@@ -0,0 +1,63 @@
+package tumble
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// RotateOnSignal rotates the logfile (see Rotate) each time one of the given
+// signals arrives, e.g. SIGHUP from logrotate-style tools:
+//
+//     defer logger.RotateOnSignal(syscall.SIGHUP)()
+//
+// The returned stop function unregisters the handler and waits for any
+// rotation in progress. It may be called more than once, and is also
+// called by Close.
+func (me *Logger) RotateOnSignal(sig ...os.Signal) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	signal.Notify(ch, sig...)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ch:
+				if err := me.Rotate(); err != nil {
+					me.reportError("RotateOnSignal", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+			wg.Wait()
+		})
+	}
+
+	me.signalMu.Lock()
+	me.signalStops = append(me.signalStops, stop)
+	me.signalMu.Unlock()
+	return stop
+}
+
+// stopSignals stops all of the RotateOnSignal handlers.
+func (me *Logger) stopSignals() {
+	me.signalMu.Lock()
+	stops := me.signalStops
+	me.signalStops = nil
+	me.signalMu.Unlock()
+
+	for _, stop := range stops {
+		stop()
+	}
+}
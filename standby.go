@@ -0,0 +1,74 @@
+package tumble
+
+import (
+	"fmt"
+	"os"
+)
+
+const standbySuffix = ".standby"
+
+// prepareStandby opens the next logfile in the background for WarmStandby,
+// unless one is already open (or being opened).
+func (me *Logger) prepareStandby() {
+	me.standbyMu.Lock()
+	defer me.standbyMu.Unlock()
+	if me.standby != nil || me.isStandbyPending {
+		return
+	}
+	me.isStandbyPending = true
+
+	fpath := me.fpath() + standbySuffix
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC | me.OpenFlags
+	me.standbyWG.Add(1)
+	go func() {
+		defer me.standbyWG.Done()
+		f, err := openFileFn(fpath, flag, me.fileMode())
+		if err != nil {
+			me.reportError("prepareStandby", fmt.Errorf("can't open standby logfile: %s", err))
+		}
+
+		me.standbyMu.Lock()
+		defer me.standbyMu.Unlock()
+		me.isStandbyPending = false
+		me.standby = f
+	}()
+}
+
+// takeStandby moves the standby logfile (if it's ready) to name, and returns
+// it. Otherwise, it returns nil and the logfile is opened as usual.
+func (me *Logger) takeStandby(name string) *os.File {
+	me.standbyMu.Lock()
+	f := me.standby
+	me.standby = nil
+	me.standbyMu.Unlock()
+	if f == nil {
+		return nil
+	}
+
+	if err := renameFn(f.Name(), name); err != nil {
+		me.reportError("openNew", fmt.Errorf("can't use standby logfile: %s", err))
+		f.Close()
+		os.Remove(f.Name())
+		return nil
+	}
+	return f
+}
+
+// closeStandby waits for the standby logfile to be opened, if that's in
+// progress, then closes and removes it.
+func (me *Logger) closeStandby() {
+	me.standbyWG.Wait()
+
+	me.standbyMu.Lock()
+	f := me.standby
+	me.standby = nil
+	me.standbyMu.Unlock()
+	if f == nil {
+		return
+	}
+
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+		me.reportError("closeStandby", err)
+	}
+}
@@ -0,0 +1,63 @@
+package tumble
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// subdirFileInfo is a file in a subdirectory, named relative to the
+// directory that was read.
+type subdirFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (me subdirFileInfo) Name() string {
+	return me.name
+}
+
+// backupDir returns the directory of an archive with the time t: either
+// dir, or its subdirectory per SubdirLayout.
+func (me *Logger) backupDir(dir string, t time.Time) string {
+	if me.SubdirLayout == "" {
+		return dir
+	}
+	return filepath.Join(dir, filepath.FromSlash(t.In(me.layout().loc).Format(me.SubdirLayout)))
+}
+
+// readBackupDir lists the files in dir. With SubdirLayout, the files in
+// its subdirectories are listed too (instead of the subdirectories).
+func (me *Logger) readBackupDir(dir string) ([]os.FileInfo, error) {
+	if me.SubdirLayout == "" {
+		return ioutil.ReadDir(dir)
+	}
+	files := []os.FileInfo{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, subdirFileInfo{info, name})
+		return nil
+	})
+	return files, err
+}
+
+// removeEmptyDirs removes subdir of dir, and its parents up to dir, as
+// long as they're empty.
+func removeEmptyDirs(dir, subdir string) {
+	for subdir != "." && subdir != string(filepath.Separator) {
+		if err := os.Remove(filepath.Join(dir, subdir)); err != nil {
+			return
+		}
+		subdir = filepath.Dir(subdir)
+	}
+}
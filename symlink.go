@@ -0,0 +1,40 @@
+package tumble
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// updateSymlink points Symlink at the logfile. The new symlink is made
+// under a temporary name and renamed over the old one, so Symlink is never
+// missing.
+func (me *Logger) updateSymlink() error {
+	target, err := filepath.Abs(me.fpath())
+	if err != nil {
+		return fmt.Errorf("can't update symlink: %s", err)
+	}
+
+	info, err := os.Lstat(me.Symlink)
+	if err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("can't update symlink: %s exists and is not a symlink", me.Symlink)
+		}
+		if current, err := os.Readlink(me.Symlink); err == nil && current == target {
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("can't update symlink: %s", err)
+	}
+
+	tmp := me.Symlink + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("can't update symlink: %s", err)
+	}
+	if err := os.Rename(tmp, me.Symlink); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("can't update symlink: %s", err)
+	}
+	return nil
+}